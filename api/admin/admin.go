@@ -0,0 +1,222 @@
+// Package admin serves the local HTTP API used to inspect and steer the
+// running node.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/node"
+	log "github.com/sirupsen/logrus"
+)
+
+type Server struct {
+	token    string
+	reloadCh chan<- struct{}
+	access   sync.RWMutex
+	node     *node.Node
+}
+
+// LimitRequest is the body of a speed limit request. Limit is in Mbps and
+// Duration in seconds, a zero limit removes the temporary limit.
+type LimitRequest struct {
+	Limit    int `json:"limit"`
+	Duration int `json:"duration"`
+}
+
+func New(token string, reloadCh chan<- struct{}) *Server {
+	return &Server{
+		token:    token,
+		reloadCh: reloadCh,
+	}
+}
+
+// SetNode replaces the node controlled by the server.
+func (s *Server) SetNode(n *node.Node) {
+	s.access.Lock()
+	s.node = n
+	s.access.Unlock()
+}
+
+// Serve starts the admin API. It returns once listen is bound.
+func (s *Server) Serve(listen string) error {
+	if s.token == "" {
+		return errors.New("admin token is empty")
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("listen admin api error: %s", err)
+	}
+	go func() {
+		if err := http.Serve(l, s.Handler()); err != nil {
+			log.WithField("err", err).Error("admin api server failed")
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Tags such as [https://host]-vless:1 do not fit in a path segment, the
+	// inbound of the users is in the tag query parameter
+	mux.HandleFunc("GET /inbounds", s.inbounds)
+	mux.HandleFunc("GET /users", s.users)
+	mux.HandleFunc("POST /users/{uid}/kick", s.kick)
+	mux.HandleFunc("POST /users/{uid}/limit", s.limit)
+	mux.HandleFunc("POST /reload", s.reload)
+	return s.auth(mux)
+}
+
+// auth checks the bearer token of every request.
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getNode(w http.ResponseWriter) *node.Node {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	if s.node == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("node not running"))
+	}
+	return s.node
+}
+
+func (s *Server) inbounds(w http.ResponseWriter, _ *http.Request) {
+	n := s.getNode(w)
+	if n == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, n.Inbounds())
+}
+
+// inboundTag returns the tag query parameter of r, or answers 400 when it
+// is missing.
+func inboundTag(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		writeError(w, http.StatusBadRequest, errors.New("tag is required"))
+		return "", false
+	}
+	return tag, true
+}
+
+func (s *Server) users(w http.ResponseWriter, r *http.Request) {
+	tag, ok := inboundTag(w, r)
+	if !ok {
+		return
+	}
+	n := s.getNode(w)
+	if n == nil {
+		return
+	}
+	users, err := n.Users(tag)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) kick(w http.ResponseWriter, r *http.Request) {
+	tag, ok := inboundTag(w, r)
+	if !ok {
+		return
+	}
+	n := s.getNode(w)
+	if n == nil {
+		return
+	}
+	uid, err := strconv.Atoi(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid uid: %s", err))
+		return
+	}
+	links, err := n.KickUser(tag, uid)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"tag":   tag,
+		"uid":   uid,
+		"links": links,
+	}).Info("User kicked through admin api")
+	writeJSON(w, http.StatusOK, map[string]int{"links": links})
+}
+
+func (s *Server) limit(w http.ResponseWriter, r *http.Request) {
+	tag, ok := inboundTag(w, r)
+	if !ok {
+		return
+	}
+	n := s.getNode(w)
+	if n == nil {
+		return
+	}
+	uid, err := strconv.Atoi(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid uid: %s", err))
+		return
+	}
+	req := &LimitRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode request error: %s", err))
+		return
+	}
+	if req.Limit < 0 || (req.Limit > 0 && req.Duration <= 0) {
+		writeError(w, http.StatusBadRequest, errors.New("limit must not be negative and needs a positive duration"))
+		return
+	}
+	err = n.LimitUser(tag, uid, req.Limit, time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"tag":      tag,
+		"uid":      uid,
+		"limit":    req.Limit,
+		"duration": req.Duration,
+	}).Info("User speed limited through admin api")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reload(w http.ResponseWriter, _ *http.Request) {
+	select {
+	case s.reloadCh <- struct{}{}:
+	default: // a reload is already queued
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, node.ErrInboundNotFound) || errors.Is(err, node.ErrUserNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/memory"
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	vCore "github.com/perfect-panel/ppanel-node/core"
+	"github.com/perfect-panel/ppanel-node/limiter"
+	"github.com/perfect-panel/ppanel-node/node"
+)
+
+// startNode starts a node serving one vless inbound with user 1 and an
+// admin API in front of it. The tag of the inbound names the panel host,
+// like the tags of real nodes.
+func startNode(t *testing.T) (*httptest.Server, string) {
+	limiter.Init()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: port, Transport: "tcp", Enable: true},
+	}
+	serverconfig := &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Protocols:  &protocols,
+		},
+	}
+	provider := memory.New(serverconfig)
+	provider.SetUsers("vless", []panel.UserInfo{
+		{Id: 1, Uuid: "b831381d-6324-4d53-ad4f-8cda48b30811", SpeedLimit: 16},
+	})
+	c := conf.New()
+	c.ApiConfig.ApiHost = "https://panel.example.com"
+	c.DataDir = t.TempDir()
+	xcore := vCore.New(c, provider)
+	if err := xcore.Start(serverconfig); err != nil {
+		t.Fatalf("XrayCore.Start() error: %v", err)
+	}
+	t.Cleanup(func() { _ = xcore.Close() })
+	n, err := node.New(xcore, c, serverconfig)
+	if err != nil {
+		t.Fatalf("node.New() error: %v", err)
+	}
+	if err := n.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	t.Cleanup(func() { _ = n.Close() })
+
+	s := New("token", make(chan struct{}, 1))
+	s.SetNode(n)
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	tag := n.Inbounds()[0].Tag
+	if !strings.ContainsAny(tag, "/:") {
+		t.Fatalf("tag = %q, want the panel host in it", tag)
+	}
+	return server, tag
+}
+
+// userPath returns path with the tag query parameter.
+func userPath(path, tag string) string {
+	return path + "?tag=" + url.QueryEscape(tag)
+}
+
+func request(t *testing.T, server *httptest.Server, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func dynamicSpeedLimit(t *testing.T, server *httptest.Server, tag string) int {
+	resp := request(t, server, http.MethodGet, userPath("/users", tag), "")
+	var users []node.UserStatus
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		t.Fatalf("decode users error: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("users = %+v, want user 1", users)
+	}
+	return users[0].DynamicSpeedLimit
+}
+
+func TestLimitUser(t *testing.T) {
+	server, tag := startNode(t)
+	path := userPath("/users/1/limit", tag)
+
+	resp := request(t, server, http.MethodPost, path, `{"limit":8,"duration":60}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("limit status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if got := dynamicSpeedLimit(t, server, tag); got != 8 {
+		t.Fatalf("dynamic speed limit = %d, want 8", got)
+	}
+
+	// A zero limit removes it
+	resp = request(t, server, http.MethodPost, path, `{"limit":0}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unlimit status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if got := dynamicSpeedLimit(t, server, tag); got != 0 {
+		t.Fatalf("dynamic speed limit = %d after unlimit, want 0", got)
+	}
+}
+
+func TestLimitUserBadRequests(t *testing.T) {
+	server, tag := startNode(t)
+	for _, tt := range []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"invalid uid", userPath("/users/abc/limit", tag), `{"limit":8,"duration":60}`, http.StatusBadRequest},
+		{"invalid body", userPath("/users/1/limit", tag), `{"limit":`, http.StatusBadRequest},
+		{"negative limit", userPath("/users/1/limit", tag), `{"limit":-1,"duration":60}`, http.StatusBadRequest},
+		{"no duration", userPath("/users/1/limit", tag), `{"limit":8}`, http.StatusBadRequest},
+		{"unknown user", userPath("/users/2/limit", tag), `{"limit":8,"duration":60}`, http.StatusNotFound},
+		{"unknown inbound", userPath("/users/1/limit", "unknown"), `{"limit":8,"duration":60}`, http.StatusNotFound},
+		{"no inbound", "/users/1/limit", `{"limit":8,"duration":60}`, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(t, server, http.MethodPost, tt.path, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+	if got := dynamicSpeedLimit(t, server, tag); got != 0 {
+		t.Fatalf("dynamic speed limit = %d after bad requests, want 0", got)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+userPath("/users/1/limit", tag),
+		strings.NewReader(`{"limit":8,"duration":60}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status without token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
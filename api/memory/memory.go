@@ -0,0 +1,223 @@
+// Package memory is a panel.Provider kept in memory, used to run the node in
+// tests without a panel.
+package memory
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+)
+
+// Provider serves the server config and users set on it and records the
+// reports of the nodes.
+type Provider struct {
+	access        sync.Mutex
+	serverConfig  *panel.ServerConfigResponse
+	serverVersion int
+	seenVersion   int
+	users         map[string][]panel.UserInfo
+	userVersion   map[string]int
+	alive         map[int]int
+	traffic       map[string]map[int]panel.UserTraffic
+	onlineUsers   map[string][]panel.OnlineUser
+	throttles     map[string][]panel.ThrottleEvent
+	status        *panel.NodeStatus
+	err           error
+}
+
+func New(serverconfig *panel.ServerConfigResponse) *Provider {
+	return &Provider{
+		serverConfig:  serverconfig,
+		serverVersion: 1,
+		users:         make(map[string][]panel.UserInfo),
+		userVersion:   make(map[string]int),
+		alive:         make(map[int]int),
+		traffic:       make(map[string]map[int]panel.UserTraffic),
+		onlineUsers:   make(map[string][]panel.OnlineUser),
+		throttles:     make(map[string][]panel.ThrottleEvent),
+	}
+}
+
+// SetServerConfig replaces the server config, it is returned by the next
+// GetServerConfig.
+func (p *Provider) SetServerConfig(serverconfig *panel.ServerConfigResponse) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.serverConfig = serverconfig
+	p.serverVersion++
+}
+
+// SetUsers replaces the users of the nodes of nodeType.
+func (p *Provider) SetUsers(nodeType string, users []panel.UserInfo) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.users[nodeType] = users
+	p.userVersion[nodeType]++
+}
+
+// SetAlive replaces the alive list served to every node.
+func (p *Provider) SetAlive(alive map[int]int) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.alive = alive
+}
+
+// SetError makes every call fail with err, nil restores the provider.
+func (p *Provider) SetError(err error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.err = err
+}
+
+// Traffic returns the traffic reported by the nodes of nodeType, summed per user.
+func (p *Provider) Traffic(nodeType string) map[int]panel.UserTraffic {
+	p.access.Lock()
+	defer p.access.Unlock()
+	traffic := make(map[int]panel.UserTraffic, len(p.traffic[nodeType]))
+	for uid, t := range p.traffic[nodeType] {
+		traffic[uid] = t
+	}
+	return traffic
+}
+
+// OnlineUsers returns the last online users reported by the nodes of nodeType.
+func (p *Provider) OnlineUsers(nodeType string) []panel.OnlineUser {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return append([]panel.OnlineUser(nil), p.onlineUsers[nodeType]...)
+}
+
+// Throttles returns the throttle events reported by the nodes of nodeType.
+func (p *Provider) Throttles(nodeType string) []panel.ThrottleEvent {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return append([]panel.ThrottleEvent(nil), p.throttles[nodeType]...)
+}
+
+// Status returns the last reported node status, nil before the first report.
+func (p *Provider) Status() *panel.NodeStatus {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return p.status
+}
+
+func (p *Provider) GetServerConfig(_ context.Context) (*panel.ServerConfigResponse, error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.seenVersion == p.serverVersion {
+		return nil, nil
+	}
+	p.seenVersion = p.serverVersion
+	return p.serverConfig, nil
+}
+
+func (p *Provider) GetCachedServerConfig() (*panel.ServerConfigResponse, error) {
+	return nil, errors.New("no cached server config")
+}
+
+func (p *Provider) NodeClient(nodeType string) (panel.NodeClient, error) {
+	return &NodeClient{
+		provider: p,
+		nodeType: nodeType,
+	}, nil
+}
+
+// NodeClient is the client of the nodes of one type.
+type NodeClient struct {
+	provider *Provider
+	nodeType string
+	version  int
+}
+
+func (c *NodeClient) GetUserList(_ context.Context) ([]panel.UserInfo, error) {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if c.version == p.userVersion[c.nodeType] {
+		return nil, nil
+	}
+	c.version = p.userVersion[c.nodeType]
+	return append([]panel.UserInfo{}, p.users[c.nodeType]...), nil
+}
+
+func (c *NodeClient) GetCachedUserList() ([]panel.UserInfo, error) {
+	return nil, errors.New("no cached user list")
+}
+
+func (c *NodeClient) GetUserAlive(_ context.Context) (map[int]int, error) {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	alive := make(map[int]int, len(p.alive))
+	for uid, n := range p.alive {
+		alive[uid] = n
+	}
+	return alive, nil
+}
+
+func (c *NodeClient) ReportUserTraffic(_ context.Context, userTraffic *[]panel.UserTraffic) error {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	traffic := p.traffic[c.nodeType]
+	if traffic == nil {
+		traffic = make(map[int]panel.UserTraffic)
+		p.traffic[c.nodeType] = traffic
+	}
+	for _, t := range *userTraffic {
+		sum := traffic[t.UID]
+		sum.UID = t.UID
+		sum.Upload += t.Upload
+		sum.Download += t.Download
+		traffic[t.UID] = sum
+	}
+	return nil
+}
+
+func (c *NodeClient) ReportNodeOnlineUsers(_ context.Context, data *[]panel.OnlineUser) error {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.onlineUsers[c.nodeType] = append([]panel.OnlineUser(nil), *data...)
+	return nil
+}
+
+func (c *NodeClient) ReportUserThrottle(_ context.Context, events *[]panel.ThrottleEvent) error {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.throttles[c.nodeType] = append(p.throttles[c.nodeType], *events...)
+	return nil
+}
+
+func (c *NodeClient) ReportNodeStatus(_ context.Context, nodeStatus *panel.NodeStatus) error {
+	p := c.provider
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	status := *nodeStatus
+	p.status = &status
+	return nil
+}
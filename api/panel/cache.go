@@ -0,0 +1,98 @@
+package panel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cache keeps the last successful panel responses with their ETags on disk,
+// so the node can start and keep serving its users while the panel is down.
+type Cache struct {
+	dir string
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// CacheFile is a cache entry being written. The previous entry is only
+// replaced once Commit succeeds.
+type CacheFile struct {
+	*os.File
+	path string
+}
+
+func (c *Cache) path(name string) string {
+	return filepath.Join(c.dir, name+".json")
+}
+
+// Create starts writing the entry name.
+func (c *Cache) Create(name string) (*CacheFile, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, fmt.Errorf("create cache dir error: %s", err)
+	}
+	f, err := os.CreateTemp(c.dir, name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create cache file error: %s", err)
+	}
+	return &CacheFile{File: f, path: c.path(name)}, nil
+}
+
+// Commit replaces the cached entry with the written body and etag.
+func (f *CacheFile) Commit(etag string) error {
+	err := f.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("write cache file error: %s", err)
+	}
+	// Written after the body: a stale etag only causes a full fetch
+	if err := os.WriteFile(f.path+".etag", []byte(etag), 0600); err != nil {
+		return fmt.Errorf("write cache etag error: %s", err)
+	}
+	return nil
+}
+
+// Abort discards the written data and keeps the previous entry.
+func (f *CacheFile) Abort() {
+	_ = f.File.Close()
+	_ = os.Remove(f.Name())
+}
+
+// Save replaces the entry name with body and etag.
+func (c *Cache) Save(name string, etag string, body []byte) error {
+	f, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Abort()
+		return fmt.Errorf("write cache file error: %s", err)
+	}
+	return f.Commit(etag)
+}
+
+// Open opens the entry name and returns its etag.
+func (c *Cache) Open(name string) (*os.File, string, error) {
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", fmt.Errorf("no cached %s", name)
+		}
+		return nil, "", fmt.Errorf("open cache file error: %s", err)
+	}
+	etag, err := os.ReadFile(c.path(name) + ".etag")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		f.Close()
+		return nil, "", fmt.Errorf("read cache etag error: %s", err)
+	}
+	return f, strings.TrimSpace(string(etag)), nil
+}
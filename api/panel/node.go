@@ -1,6 +1,7 @@
 package panel
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"time"
@@ -29,7 +30,7 @@ type NodeStatus struct {
 	Uptime uint64
 }
 
-func (c *ClientV1) ReportNodeStatus(nodeStatus *NodeStatus) (err error) {
+func (c *ClientV1) ReportNodeStatus(ctx context.Context, nodeStatus *NodeStatus) (err error) {
 	p := "/v1/server/status"
 	status := ServerPushStatusRequest{
 		Cpu:       nodeStatus.CPU,
@@ -37,7 +38,12 @@ func (c *ClientV1) ReportNodeStatus(nodeStatus *NodeStatus) (err error) {
 		Disk:      nodeStatus.Disk,
 		UpdatedAt: time.Now().UnixMilli(),
 	}
-	if _, err = c.Client.R().SetBody(status).ForceContentType("application/json").Post(p); err != nil {
+	if _, err = c.Client.R().
+		SetContext(ctx).
+		SetHeader(idempotencyKeyHeader, idempotencyKey(ctx)).
+		SetBody(status).
+		ForceContentType("application/json").
+		Post(p); err != nil {
 		return fmt.Errorf("访问 %s 失败: %v", path.Join(c.APIHost+p), err.Error())
 	}
 	return nil
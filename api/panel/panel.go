@@ -1,8 +1,14 @@
 package panel
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	mrand "math/rand/v2"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -10,18 +16,22 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/perfect-panel/ppanel-node/common/metrics"
 	"github.com/perfect-panel/ppanel-node/conf"
 )
 
 type ClientV1 struct {
-	Client    *resty.Client
-	APIHost   string
-	SecretKey string
-	NodeType  string
-	NodeId    int
-	userEtag  string
-	UserList  *UserListBody
-	AliveMap  *AliveMap
+	Client              *resty.Client
+	APIHost             string
+	SecretKey           string
+	NodeType            string
+	NodeId              int
+	userEtag            string
+	aliveUnsupported    bool
+	throttleUnsupported bool
+	UserList            *UserListBody
+	AliveMap            *AliveMap
+	Cache               *Cache
 }
 
 type ClientV2 struct {
@@ -31,11 +41,24 @@ type ClientV2 struct {
 	ServerId         int
 	ServerConfigEtag string
 	responseBodyHash string
+	Cache            *Cache
+}
+
+// idempotencyKeyHeader identifies a push, so the panel can drop its retries.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// defaultRetryStatusCodes are retried when no status codes are configured.
+var defaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
 }
 
 func NewClientV1(c *conf.NodeApiConfig) (*ClientV1, error) {
 	client := resty.New()
-	client.SetRetryCount(0)
+	setRetryPolicy(client, &c.Retry)
 	if c.Timeout > 0 {
 		client.SetTimeout(time.Duration(c.Timeout) * time.Second)
 	} else {
@@ -47,6 +70,7 @@ func NewClientV1(c *conf.NodeApiConfig) (*ClientV1, error) {
 			logrus.Error(v.Err)
 		}
 	})
+	setMetrics(client)
 	client.SetBaseURL(c.APIHost)
 	// Check node type
 	c.NodeType = strings.ToLower(c.NodeType)
@@ -82,7 +106,7 @@ func NewClientV1(c *conf.NodeApiConfig) (*ClientV1, error) {
 
 func NewClientV2(c *conf.ServerApiConfig) *ClientV2 {
 	client := resty.New()
-	client.SetRetryCount(0)
+	setRetryPolicy(client, &c.Retry)
 	if c.Timeout > 0 {
 		client.SetTimeout(time.Duration(c.Timeout) * time.Second)
 	} else {
@@ -94,6 +118,7 @@ func NewClientV2(c *conf.ServerApiConfig) *ClientV2 {
 			logrus.Error(v.Err)
 		}
 	})
+	setMetrics(client)
 	client.SetBaseURL(c.ApiHost)
 	client.SetQueryParams(map[string]string{
 		"secret_key": c.SecretKey,
@@ -105,3 +130,117 @@ func NewClientV2(c *conf.ServerApiConfig) *ClientV2 {
 		ServerId:  c.ServerId,
 	}
 }
+
+// setMetrics records the duration and the failures of the panel requests.
+func setMetrics(client *resty.Client) {
+	client.OnSuccess(func(_ *resty.Client, r *resty.Response) {
+		endpoint := requestEndpoint(r.Request)
+		metrics.PanelRequestDuration.WithLabelValues(endpoint).Observe(r.Time().Seconds())
+		if r.IsError() {
+			metrics.PanelRequestErrors.WithLabelValues(endpoint).Inc()
+		}
+	})
+	client.OnError(func(req *resty.Request, _ error) {
+		endpoint := requestEndpoint(req)
+		metrics.PanelRequestDuration.WithLabelValues(endpoint).Observe(time.Since(req.Time).Seconds())
+		metrics.PanelRequestErrors.WithLabelValues(endpoint).Inc()
+	})
+}
+
+// requestEndpoint returns the path of req, without the query holding the secret key.
+func requestEndpoint(req *resty.Request) string {
+	if req.RawRequest != nil {
+		return req.RawRequest.URL.Path
+	}
+	return ""
+}
+
+// setRetryPolicy applies the retry policy to the client. Only idempotent
+// requests are retried: GET requests, and pushes with an idempotency key
+// when the panel honours it.
+func setRetryPolicy(client *resty.Client, c *conf.RetryConfig) {
+	if c.MaxAttempts <= 1 {
+		client.SetRetryCount(0)
+		return
+	}
+	statusCodes := c.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = defaultRetryStatusCodes
+	}
+	client.SetRetryCount(c.MaxAttempts - 1)
+	client.SetRetryWaitTime(0)
+	if c.MaxBackoff > 0 {
+		client.SetRetryMaxWaitTime(c.MaxBackoff)
+	}
+	client.SetRetryAfter(func(_ *resty.Client, r *resty.Response) (time.Duration, error) {
+		return retryBackoff(c, r.Request.Attempt), nil
+	})
+	client.AddRetryCondition(func(r *resty.Response, err error) bool {
+		if r == nil || r.Request == nil {
+			return false
+		}
+		// A push that timed out may have been accepted, only a panel
+		// honouring its key can tell a retry from a new push
+		if r.Request.Method != http.MethodGet &&
+			(!c.IdempotentPushes || r.Request.Header.Get(idempotencyKeyHeader) == "") {
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		return slices.Contains(statusCodes, r.StatusCode())
+	})
+	client.AddRetryHook(func(r *resty.Response, err error) {
+		// the body of an unparsed response is not closed by resty
+		if r != nil && r.RawResponse != nil && r.RawResponse.Body != nil {
+			r.RawResponse.Body.Close()
+		}
+		logrus.WithFields(logrus.Fields{
+			"url":     r.Request.URL,
+			"attempt": r.Request.Attempt,
+			"status":  r.StatusCode(),
+			"err":     err,
+		}).Warn("Panel request failed")
+	})
+}
+
+// retryBackoff returns the delay after the given attempt: the base backoff
+// doubled per attempt, capped at the max backoff and reduced by up to the
+// jitter fraction.
+func retryBackoff(c *conf.RetryConfig, attempt int) time.Duration {
+	backoff := c.BaseBackoff
+	for i := 1; i < attempt && (c.MaxBackoff <= 0 || backoff < c.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if c.MaxBackoff > 0 {
+		backoff = min(backoff, c.MaxBackoff)
+	}
+	if c.Jitter > 0 && backoff > 0 {
+		backoff -= time.Duration(mrand.Float64() * min(c.Jitter, 1) * float64(backoff))
+	}
+	return max(backoff, time.Millisecond)
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey returns a context whose pushes carry key, so a push
+// retried by the caller is recognised by the panel as the same request.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+// idempotencyKey returns the key of ctx, or a new key when ctx has none.
+// Retries of a request by the client reuse its key.
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyContext{}).(string); ok && key != "" {
+		return key
+	}
+	return NewIdempotencyKey()
+}
+
+// NewIdempotencyKey returns a random idempotency key.
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,305 @@
+// Package paneltest provides a fake PPanel server for tests. It serves the
+// endpoints the node calls and records what the node reports.
+package paneltest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+// Server is a fake panel. Users and reports are kept per protocol type.
+type Server struct {
+	*httptest.Server
+	ServerID  int
+	SecretKey string
+	access    sync.Mutex
+	data      *panel.Data
+	users     map[string][]panel.UserInfo
+	alive     map[int]int
+	traffic   map[string]map[int]panel.UserTraffic
+	online    map[string][]panel.OnlineUser
+	throttles map[string][]panel.ThrottleEvent
+	status    map[string]*panel.ServerPushStatusRequest
+	requests  map[string]int
+	pushed    map[string]bool // Key: idempotency key of an accepted push
+	lost      int             // traffic pushes to answer with an error
+}
+
+// NewServer starts a fake panel serving data as the config of the server
+// serverID. It has no alive list until SetAlive is called. Close it when
+// done.
+func NewServer(serverID int, secretKey string, data *panel.Data) *Server {
+	s := &Server{
+		ServerID:  serverID,
+		SecretKey: secretKey,
+		data:      data,
+		users:     make(map[string][]panel.UserInfo),
+		traffic:   make(map[string]map[int]panel.UserTraffic),
+		online:    make(map[string][]panel.OnlineUser),
+		throttles: make(map[string][]panel.ThrottleEvent),
+		status:    make(map[string]*panel.ServerPushStatusRequest),
+		requests:  make(map[string]int),
+		pushed:    make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/server/{id}", s.serverConfig)
+	mux.HandleFunc("GET /v1/server/user", s.userList)
+	mux.HandleFunc("GET /v1/server/alivelist", s.aliveList)
+	mux.HandleFunc("POST /v1/server/push", s.push)
+	mux.HandleFunc("POST /v1/server/online", s.pushOnline)
+	mux.HandleFunc("POST /v1/server/throttle", s.pushThrottle)
+	mux.HandleFunc("POST /v1/server/status", s.pushStatus)
+	s.Server = httptest.NewServer(s.auth(mux))
+	return s
+}
+
+// ApiConfig returns the config of a node using the fake panel. Requests
+// are not retried.
+func (s *Server) ApiConfig() conf.ServerApiConfig {
+	return conf.ServerApiConfig{
+		ApiHost:   s.URL,
+		ServerId:  s.ServerID,
+		SecretKey: s.SecretKey,
+		Timeout:   5,
+	}
+}
+
+// SetServerConfig replaces the served server config.
+func (s *Server) SetServerConfig(data *panel.Data) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.data = data
+}
+
+// SetUsers replaces the users of the nodes of protocol.
+func (s *Server) SetUsers(protocol string, users []panel.UserInfo) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.users[protocol] = users
+}
+
+// SetAlive replaces the alive list, nil answers 404 like panels without it.
+func (s *Server) SetAlive(alive map[int]int) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.alive = alive
+}
+
+// Traffic returns the traffic pushed by the nodes of protocol, summed per user.
+func (s *Server) Traffic(protocol string) map[int]panel.UserTraffic {
+	s.access.Lock()
+	defer s.access.Unlock()
+	traffic := make(map[int]panel.UserTraffic, len(s.traffic[protocol]))
+	for uid, t := range s.traffic[protocol] {
+		traffic[uid] = t
+	}
+	return traffic
+}
+
+// OnlineUsers returns the last online users pushed by the nodes of protocol.
+func (s *Server) OnlineUsers(protocol string) []panel.OnlineUser {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return append([]panel.OnlineUser(nil), s.online[protocol]...)
+}
+
+// Throttles returns the throttle events pushed by the nodes of protocol.
+func (s *Server) Throttles(protocol string) []panel.ThrottleEvent {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return append([]panel.ThrottleEvent(nil), s.throttles[protocol]...)
+}
+
+// Status returns the last status pushed by the nodes of protocol.
+func (s *Server) Status(protocol string) *panel.ServerPushStatusRequest {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.status[protocol]
+}
+
+// LosePushes answers the next n new traffic pushes with an error after
+// counting them, like pushes whose answer was lost.
+func (s *Server) LosePushes(n int) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.lost = n
+}
+
+// Requests returns the number of requests served with a full body for the
+// path, 304 responses are not counted, and of traffic pushes.
+func (s *Server) Requests(path string) int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("secret_key") != s.SecretKey {
+			http.Error(w, "invalid secret key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) serverConfig(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("id") != strconv.Itoa(s.ServerID) {
+		http.Error(w, "server not found", http.StatusNotFound)
+		return
+	}
+	s.access.Lock()
+	body, err := json.Marshal(&panel.ServerConfigResponse{Code: 200, Msg: "success", Data: s.data})
+	s.access.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeWithETag(w, r, body)
+}
+
+func (s *Server) userList(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("server_id") != strconv.Itoa(s.ServerID) {
+		http.Error(w, "server not found", http.StatusNotFound)
+		return
+	}
+	s.access.Lock()
+	users := s.users[r.URL.Query().Get("protocol")]
+	if users == nil {
+		users = []panel.UserInfo{}
+	}
+	body, err := json.Marshal(&panel.UserListBody{Users: users})
+	s.access.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeWithETag(w, r, body)
+}
+
+func (s *Server) aliveList(w http.ResponseWriter, r *http.Request) {
+	s.access.Lock()
+	alive := s.alive
+	body, err := json.Marshal(&panel.AliveMap{Alive: alive})
+	s.access.Unlock()
+	if alive == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// writeWithETag writes body, or 304 when the request carries its ETag.
+func (s *Server) writeWithETag(w http.ResponseWriter, r *http.Request, body []byte) {
+	hash := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:8]))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.access.Lock()
+	s.requests[r.URL.Path]++
+	s.access.Unlock()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func (s *Server) push(w http.ResponseWriter, r *http.Request) {
+	req := &panel.ServerPushUserTrafficRequest{}
+	if !decode(w, r, req) {
+		return
+	}
+	protocol := r.URL.Query().Get("protocol")
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.requests[r.URL.Path]++
+	// Like a panel honouring the key, a push with a key already accepted is
+	// not counted again
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if s.pushed[key] {
+			writeOK(w)
+			return
+		}
+		s.pushed[key] = true
+	}
+	traffic := s.traffic[protocol]
+	if traffic == nil {
+		traffic = make(map[int]panel.UserTraffic)
+		s.traffic[protocol] = traffic
+	}
+	for _, t := range req.Traffic {
+		sum := traffic[t.UID]
+		sum.UID = t.UID
+		sum.Upload += t.Upload
+		sum.Download += t.Download
+		traffic[t.UID] = sum
+	}
+	if s.lost > 0 {
+		s.lost--
+		http.Error(w, "answer lost", http.StatusServiceUnavailable)
+		return
+	}
+	writeOK(w)
+}
+
+func (s *Server) pushOnline(w http.ResponseWriter, r *http.Request) {
+	req := &panel.UserOnlineBody{}
+	if !decode(w, r, req) {
+		return
+	}
+	s.access.Lock()
+	s.online[r.URL.Query().Get("protocol")] = req.Users
+	s.access.Unlock()
+	writeOK(w)
+}
+
+func (s *Server) pushThrottle(w http.ResponseWriter, r *http.Request) {
+	req := &panel.UserThrottleBody{}
+	if !decode(w, r, req) {
+		return
+	}
+	protocol := r.URL.Query().Get("protocol")
+	s.access.Lock()
+	s.throttles[protocol] = append(s.throttles[protocol], req.Events...)
+	s.access.Unlock()
+	writeOK(w)
+}
+
+func (s *Server) pushStatus(w http.ResponseWriter, r *http.Request) {
+	req := &panel.ServerPushStatusRequest{}
+	if !decode(w, r, req) {
+		return
+	}
+	s.access.Lock()
+	s.status[r.URL.Query().Get("protocol")] = req
+	s.access.Unlock()
+	writeOK(w)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"code":200,"msg":"success"}`))
+}
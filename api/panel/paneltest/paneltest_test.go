@@ -0,0 +1,54 @@
+package paneltest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+)
+
+func TestLostPushRetries(t *testing.T) {
+	data := &panel.Data{Protocols: &[]panel.Protocol{{Type: "vless", Port: 443, Enable: true}}}
+	traffic := []panel.UserTraffic{{UID: 1, Upload: 1, Download: 1}}
+	for _, tt := range []struct {
+		name       string
+		idempotent bool
+		err        bool
+		requests   int
+	}{
+		// The retry of the lost push reuses its key and is not counted again
+		{"idempotent", true, false, 2},
+		// Without the key honoured, the push is left to the caller
+		{"not idempotent", false, true, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(1, "secret", data)
+			defer s.Close()
+			config := s.ApiConfig()
+			config.Retry.MaxAttempts = 3
+			config.Retry.BaseBackoff = time.Millisecond
+			config.Retry.IdempotentPushes = tt.idempotent
+			api, err := panel.New(&config, "").NodeClient("vless")
+			if err != nil {
+				t.Fatalf("NodeClient() error: %v", err)
+			}
+
+			s.LosePushes(1)
+			ctx := panel.WithIdempotencyKey(context.Background(), "batch-1")
+			if err := api.ReportUserTraffic(ctx, &traffic); (err != nil) != tt.err {
+				t.Fatalf("ReportUserTraffic() error = %v, want error %v", err, tt.err)
+			}
+			if got := s.Requests("/v1/server/push"); got != tt.requests {
+				t.Fatalf("pushes = %d, want %d", got, tt.requests)
+			}
+			// The caller pushing the batch again with its key is counted once too
+			if err := api.ReportUserTraffic(ctx, &traffic); err != nil {
+				t.Fatalf("ReportUserTraffic() error: %v", err)
+			}
+			if got := s.Traffic("vless")[1]; got != traffic[0] {
+				t.Fatalf("traffic = %+v, want %+v counted once", got, traffic[0])
+			}
+		})
+	}
+}
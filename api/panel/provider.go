@@ -0,0 +1,83 @@
+package panel
+
+import (
+	"context"
+
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+// Provider is the control plane the node gets its server config from.
+type Provider interface {
+	// GetServerConfig returns nil when the config did not change since
+	// the last call.
+	GetServerConfig(ctx context.Context) (*ServerConfigResponse, error)
+	// GetCachedServerConfig returns the last known server config, used
+	// when the control plane is unreachable.
+	GetCachedServerConfig() (*ServerConfigResponse, error)
+	// NodeClient returns the client of the nodes of nodeType.
+	NodeClient(nodeType string) (NodeClient, error)
+}
+
+// NodeClient serves the users of one node and takes its reports.
+type NodeClient interface {
+	// GetUserList returns nil when the users did not change since the
+	// last call.
+	GetUserList(ctx context.Context) ([]UserInfo, error)
+	// GetCachedUserList returns the last known users, used when the
+	// control plane is unreachable.
+	GetCachedUserList() ([]UserInfo, error)
+	// GetUserAlive returns the number of IPs each user is online with on
+	// all nodes.
+	GetUserAlive(ctx context.Context) (map[int]int, error)
+	ReportUserTraffic(ctx context.Context, userTraffic *[]UserTraffic) error
+	ReportNodeOnlineUsers(ctx context.Context, data *[]OnlineUser) error
+	// ReportUserThrottle reports the users capped by the dynamic speed
+	// limit rules of the node, when LimitConfig.ReportThrottle is set.
+	// Providers without a place for them drop them and return nil.
+	ReportUserThrottle(ctx context.Context, events *[]ThrottleEvent) error
+	ReportNodeStatus(ctx context.Context, nodeStatus *NodeStatus) error
+}
+
+// Panel is the Provider of the PPanel API.
+type Panel struct {
+	config *conf.ServerApiConfig
+	client *ClientV2
+	cache  *Cache
+}
+
+// New returns the Provider of the panel configured by c. Responses are
+// cached in the directory cacheDir, nothing is cached when it is empty.
+func New(c *conf.ServerApiConfig, cacheDir string) *Panel {
+	p := &Panel{
+		config: c,
+		client: NewClientV2(c),
+	}
+	if cacheDir != "" {
+		p.cache = NewCache(cacheDir)
+		p.client.Cache = p.cache
+	}
+	return p
+}
+
+func (p *Panel) GetServerConfig(ctx context.Context) (*ServerConfigResponse, error) {
+	return GetServerConfig(ctx, p.client)
+}
+
+func (p *Panel) GetCachedServerConfig() (*ServerConfigResponse, error) {
+	return GetCachedServerConfig(p.client)
+}
+
+func (p *Panel) NodeClient(nodeType string) (NodeClient, error) {
+	c, err := NewClientV1(&conf.NodeApiConfig{
+		APIHost:   p.config.ApiHost,
+		NodeType:  nodeType,
+		NodeID:    p.config.ServerId,
+		SecretKey: p.config.SecretKey,
+		Retry:     p.config.Retry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Cache = p.cache
+	return c, nil
+}
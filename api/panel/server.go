@@ -6,6 +6,9 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type ServerConfigResponse struct {
@@ -68,6 +71,9 @@ type Protocol struct {
 	Type                    string `json:"type"`
 	Port                    int    `json:"port"`
 	Enable                  bool   `json:"enable"`
+	SpeedLimit              int    `json:"speed_limit"`
+	UpSpeedLimit            int    `json:"up_speed_limit"`
+	DownSpeedLimit          int    `json:"down_speed_limit"`
 	Security                string `json:"security"`
 	SNI                     string `json:"sni"`
 	AllowInsecure           bool   `json:"allow_insecure"`
@@ -111,6 +117,22 @@ type Protocol struct {
 	CertMode                string `json:"cert_mode"`
 	CertDNSProvider         string `json:"cert_dns_provider"`
 	CertDNSEnv              string `json:"cert_dns_env"`
+
+	// SpeedSchedules lower the speed limits of the inbound at times of day
+	SpeedSchedules *[]SpeedSchedule `json:"speed_schedules"`
+}
+
+// SpeedSchedule lowers speed limits every day from Start to End, local times
+// of the node such as "20:00" and "23:00". The speed limits of the users in
+// Groups, all users when empty, are scaled to Percent and capped at
+// SpeedLimit Mbps. TotalSpeedLimit caps all users of the inbound together.
+type SpeedSchedule struct {
+	Start           string   `json:"start"`
+	End             string   `json:"end"`
+	Groups          []string `json:"groups"`
+	Percent         int      `json:"percent"`
+	SpeedLimit      int      `json:"speed_limit"`
+	TotalSpeedLimit int      `json:"total_speed_limit"`
 }
 
 func GetServerConfig(ctx context.Context, c *ClientV2) (*ServerConfigResponse, error) {
@@ -154,13 +176,57 @@ func GetServerConfig(ctx context.Context, c *ClientV2) (*ServerConfigResponse, e
 	} else {
 		return nil, fmt.Errorf("服务端返回为空")
 	}
+	resp, err := DecodeServerConfig(r.Body())
+	if err != nil {
+		return nil, err
+	}
+	if c.Cache != nil {
+		if err := c.Cache.Save(c.cacheName(), c.ServerConfigEtag, r.Body()); err != nil {
+			log.WithField("err", err).Warn("缓存服务端配置失败")
+		}
+	}
+	return resp, nil
+}
+
+// GetCachedServerConfig returns the last server config fetched from the
+// panel. The ETag and body hash of the client are set from the cache, so
+// the panel is only asked for changes afterwards.
+func GetCachedServerConfig(c *ClientV2) (*ServerConfigResponse, error) {
+	if c.Cache == nil {
+		return nil, fmt.Errorf("缓存未启用")
+	}
+	f, etag, err := c.Cache.Open(c.cacheName())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("读取缓存失败: %s", err)
+	}
+	resp, err := DecodeServerConfig(body)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+	c.responseBodyHash = hex.EncodeToString(hash[:])
+	c.ServerConfigEtag = etag
+	return resp, nil
+}
+
+// DecodeServerConfig decodes a server config response body.
+func DecodeServerConfig(body []byte) (*ServerConfigResponse, error) {
 	resp := &ServerConfigResponse{}
-	err = json.Unmarshal(r.Body(), resp)
+	err := json.Unmarshal(body, resp)
 	if err != nil {
 		return nil, fmt.Errorf("解码响应体失败: %s", err)
 	}
-	if resp.Data.Protocols == nil {
+	if resp.Data == nil || resp.Data.Protocols == nil {
 		return nil, fmt.Errorf("协议配置为空")
 	}
 	return resp, nil
 }
+
+func (c *ClientV2) cacheName() string {
+	return fmt.Sprintf("server-%d", c.ServerId)
+}
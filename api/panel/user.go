@@ -3,10 +3,14 @@ package panel
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"path"
 
 	"encoding/json/jsontext"
 	"encoding/json/v2"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type OnlineUser struct {
@@ -14,11 +18,27 @@ type OnlineUser struct {
 	IP  string
 }
 
+// UserInfo is a user of the node. SpeedLimit is in Mbps for each direction,
+// UpSpeedLimit and DownSpeedLimit lower the limit of one direction. ConnLimit
+// caps the open connections of the user on the node. Burst is the MB the
+// speed limit lets through at once and the first FullSpeed MB of each
+// connection are not held to it, the node config applies when zero. Group
+// selects the speed schedules applying to the user. Quota is
+// the traffic allowance of the user in bytes, zero is unlimited, and Used is
+// the traffic the panel already counted against it.
 type UserInfo struct {
-	Id          int    `json:"id"`
-	Uuid        string `json:"uuid"`
-	SpeedLimit  int    `json:"speed_limit"`
-	DeviceLimit int    `json:"device_limit"`
+	Id             int    `json:"id"`
+	Uuid           string `json:"uuid"`
+	SpeedLimit     int    `json:"speed_limit"`
+	UpSpeedLimit   int    `json:"up_speed_limit"`
+	DownSpeedLimit int    `json:"down_speed_limit"`
+	DeviceLimit    int    `json:"device_limit"`
+	ConnLimit      int    `json:"conn_limit"`
+	Burst          int    `json:"burst"`
+	FullSpeed      int    `json:"full_speed"`
+	Group          string `json:"group"`
+	Quota          int64  `json:"quota"`
+	Used           int64  `json:"used"`
 }
 
 type UserListBody struct {
@@ -57,8 +77,66 @@ func (c *ClientV1) GetUserList(ctx context.Context) ([]UserInfo, error) {
 		body := r.Body()
 		return nil, fmt.Errorf("访问 %s 失败: %s", path.Join(c.APIHost+p), string(body))
 	}
+	var body io.Reader = r.RawResponse.Body
+	var cache *CacheFile
+	if c.Cache != nil {
+		if cache, err = c.Cache.Create(c.cacheName()); err != nil {
+			log.WithField("err", err).Warn("缓存用户列表失败")
+			cache = nil
+		} else {
+			body = io.TeeReader(body, cache)
+		}
+	}
+	users, err := decodeUserList(body)
+	if err != nil {
+		if cache != nil {
+			cache.Abort()
+		}
+		return nil, err
+	}
+	c.userEtag = r.Header().Get("ETag")
+	if cache != nil {
+		// read the rest of the body, so the cached copy is complete
+		_, err = io.Copy(io.Discard, body)
+		if err == nil {
+			err = cache.Commit(c.userEtag)
+		} else {
+			cache.Abort()
+		}
+		if err != nil {
+			log.WithField("err", err).Warn("缓存用户列表失败")
+		}
+	}
+	return users, nil
+}
+
+// GetCachedUserList returns the last user list fetched from the panel. The
+// ETag of the client is set from the cache, so the panel is only asked for
+// changes afterwards.
+func (c *ClientV1) GetCachedUserList() ([]UserInfo, error) {
+	if c.Cache == nil {
+		return nil, fmt.Errorf("缓存未启用")
+	}
+	f, etag, err := c.Cache.Open(c.cacheName())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := decodeUserList(f)
+	if err != nil {
+		return nil, err
+	}
+	c.userEtag = etag
+	return users, nil
+}
+
+func (c *ClientV1) cacheName() string {
+	return fmt.Sprintf("users-%s%d", c.NodeType, c.NodeId)
+}
+
+func decodeUserList(r io.Reader) ([]UserInfo, error) {
 	userlist := &UserListBody{}
-	dec := jsontext.NewDecoder(r.RawResponse.Body)
+	dec := jsontext.NewDecoder(r)
 	for {
 		tok, err := dec.ReadToken()
 		if err != nil {
@@ -86,31 +164,41 @@ func (c *ClientV1) GetUserList(ctx context.Context) ([]UserInfo, error) {
 		}
 		userlist.Users = append(userlist.Users, u)
 	}
-	c.userEtag = r.Header().Get("ETag")
 	return userlist.Users, nil
 }
 
-func (c *ClientV1) GetUserAlive() (map[int]int, error) {
-	c.AliveMap = &AliveMap{}
-	c.AliveMap.Alive = make(map[int]int)
-	/*const path = "/v1/server/alivelist"
-	r, err := c.client.R().
+// GetUserAlive returns the number of IPs each user is online with on all
+// nodes. Panels without the alive list answer 404, an empty list is then
+// returned and the device limits only count the IPs of this node.
+func (c *ClientV1) GetUserAlive(ctx context.Context) (map[int]int, error) {
+	const p = "/v1/server/alivelist"
+	r, err := c.Client.R().
+		SetContext(ctx).
 		ForceContentType("application/json").
-		Get(path)
-	if err != nil || r.StatusCode() >= 399 {
-		c.AliveMap.Alive = make(map[int]int)
+		Get(p)
+	if err != nil {
+		return nil, fmt.Errorf("访问 %s 失败: %s", path.Join(c.APIHost+p), err)
 	}
-	if r == nil || r.RawResponse == nil {
-		fmt.Printf("received nil response or raw response")
-		c.AliveMap.Alive = make(map[int]int)
+	if r.StatusCode() == http.StatusNotFound {
+		if !c.aliveUnsupported {
+			log.Warn("面板不支持在线设备列表，设备数限制仅统计本节点")
+			c.aliveUnsupported = true
+		}
+		return make(map[int]int), nil
 	}
-	defer r.RawResponse.Body.Close()
-	if err := json.Unmarshal(r.Body(), c.AliveMap); err != nil {
-		//fmt.Printf("unmarshal user alive list error: %s", err)
-		c.AliveMap.Alive = make(map[int]int)
+	if r.StatusCode() >= 400 {
+		return nil, fmt.Errorf("访问 %s 失败: %s", path.Join(c.APIHost+p), string(r.Body()))
+	}
+	alive := &AliveMap{}
+	if err := json.Unmarshal(r.Body(), alive); err != nil {
+		return nil, fmt.Errorf("解码在线设备列表失败: %w", err)
+	}
+	if alive.Alive == nil {
+		alive.Alive = make(map[int]int)
 	}
-	*/
-	return c.AliveMap.Alive, nil
+	c.aliveUnsupported = false
+	c.AliveMap = alive
+	return alive.Alive, nil
 }
 
 type ServerPushUserTrafficRequest struct {
@@ -138,6 +226,7 @@ func (c *ClientV1) ReportUserTraffic(ctx context.Context, userTraffic *[]UserTra
 	}
 	r, err := c.Client.R().
 		SetContext(ctx).
+		SetHeader(idempotencyKeyHeader, idempotencyKey(ctx)).
 		SetBody(req).
 		ForceContentType("application/json").
 		Post(p)
@@ -159,6 +248,7 @@ func (c *ClientV1) ReportNodeOnlineUsers(ctx context.Context, data *[]OnlineUser
 	}
 	r, err := c.Client.R().
 		SetContext(ctx).
+		SetHeader(idempotencyKeyHeader, idempotencyKey(ctx)).
 		SetBody(users).
 		ForceContentType("application/json").
 		Post(p)
@@ -172,3 +262,48 @@ func (c *ClientV1) ReportNodeOnlineUsers(ctx context.Context, data *[]OnlineUser
 
 	return nil
 }
+
+// ThrottleEvent is a user capped at SpeedLimit Mbps until Expire, a unix
+// time, by the dynamic rule at index Rule of the node. Speed and Connections
+// are what the user was measured at.
+type ThrottleEvent struct {
+	UID         int   `json:"uid"`
+	Rule        int   `json:"rule"`
+	Speed       int   `json:"speed"`
+	Connections int   `json:"connections"`
+	SpeedLimit  int   `json:"speed_limit"`
+	Time        int64 `json:"time"`
+	Expire      int64 `json:"expire"`
+}
+
+type UserThrottleBody struct {
+	Events []ThrottleEvent `json:"events"`
+}
+
+// ReportUserThrottle pushes throttle events to the panel. Not every panel
+// takes them: on a 404 a warning is logged once and the events are dropped.
+func (c *ClientV1) ReportUserThrottle(ctx context.Context, events *[]ThrottleEvent) error {
+	const p = "/v1/server/throttle"
+	r, err := c.Client.R().
+		SetContext(ctx).
+		SetHeader(idempotencyKeyHeader, idempotencyKey(ctx)).
+		SetBody(UserThrottleBody{Events: *events}).
+		ForceContentType("application/json").
+		Post(p)
+	if err != nil {
+		return fmt.Errorf("访问 %s 失败: %s", path.Join(c.APIHost+p), err)
+	}
+	if r.StatusCode() == http.StatusNotFound {
+		if !c.throttleUnsupported {
+			log.Warn("面板不支持限速事件上报，限速事件仅记录在日志中")
+			c.throttleUnsupported = true
+		}
+		return nil
+	}
+	if r.StatusCode() >= 400 {
+		body := r.Body()
+		return fmt.Errorf("访问 %s 失败: %s", path.Join(c.APIHost+p), string(body))
+	}
+	c.throttleUnsupported = false
+	return nil
+}
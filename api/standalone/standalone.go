@@ -0,0 +1,216 @@
+// Package standalone serves the node protocols and users from a local file,
+// so the node can run without a panel.
+package standalone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	log "github.com/sirupsen/logrus"
+)
+
+// File is the standalone file. The server config fields are those of the
+// panel, users are served to every protocol.
+type File struct {
+	panel.Data
+	Users []panel.UserInfo `json:"users"`
+}
+
+// Provider is the panel.Provider serving the content of the standalone
+// file. Traffic reports are written as json lines to the traffic output.
+type Provider struct {
+	path        string
+	output      io.Writer
+	closer      io.Closer
+	access      sync.RWMutex
+	file        *File
+	version     int
+	seenVersion int
+}
+
+// TrafficRecord is one traffic report written to the traffic output.
+type TrafficRecord struct {
+	Time    int64               `json:"time"`
+	Type    string              `json:"type"`
+	Traffic []panel.UserTraffic `json:"traffic"`
+}
+
+// New loads the file at path. Traffic is written to the file traffic, or to
+// stdout when it is empty or "stdout".
+func New(path string, traffic string) (*Provider, error) {
+	p := &Provider{path: path}
+	if err := p.Load(); err != nil {
+		return nil, err
+	}
+	if traffic == "" || traffic == "stdout" {
+		p.output = os.Stdout
+		return p, nil
+	}
+	f, err := os.OpenFile(traffic, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open traffic output error: %s", err)
+	}
+	p.output = f
+	p.closer = f
+	return p, nil
+}
+
+// Load reads the file again. The previous content is kept on error.
+func (p *Provider) Load() error {
+	f, err := ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	p.access.Lock()
+	p.file = f
+	p.version++
+	p.access.Unlock()
+	return nil
+}
+
+// ReadFile reads and checks a standalone file, yaml or json.
+func ReadFile(path string) (*File, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read standalone file error: %s", err)
+	}
+	f := &File{}
+	if err := yaml.Unmarshal(body, f); err != nil {
+		return nil, fmt.Errorf("decode standalone file error: %s", err)
+	}
+	if f.Protocols == nil || len(*f.Protocols) == 0 {
+		return nil, fmt.Errorf("standalone file %s has no protocols", path)
+	}
+	if f.Total == 0 {
+		for _, protocol := range *f.Protocols {
+			if protocol.Enable {
+				f.Total++
+			}
+		}
+	}
+	return f, nil
+}
+
+// Watch reloads the file when it changes. The changes are picked up by the
+// core and the nodes when they pull next.
+func (p *Provider) Watch() error {
+	return conf.Watch(p.path, func() {
+		if err := p.Load(); err != nil {
+			log.WithField("err", err).Error("重新加载单机配置失败")
+			return
+		}
+		log.Info("单机配置已重新加载")
+	})
+}
+
+// Path returns the path of the standalone file.
+func (p *Provider) Path() string {
+	return p.path
+}
+
+func (p *Provider) Close() error {
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+// ServerConfig returns the current server config.
+func (p *Provider) ServerConfig() *panel.ServerConfigResponse {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.seenVersion = p.version
+	data := p.file.Data
+	return &panel.ServerConfigResponse{Data: &data}
+}
+
+// GetServerConfig returns the server config, or nil when the file did not
+// change since the last call.
+func (p *Provider) GetServerConfig(_ context.Context) (*panel.ServerConfigResponse, error) {
+	p.access.RLock()
+	unchanged := p.seenVersion == p.version
+	p.access.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+	return p.ServerConfig(), nil
+}
+
+// GetCachedServerConfig is never used, GetServerConfig does not fail.
+func (p *Provider) GetCachedServerConfig() (*panel.ServerConfigResponse, error) {
+	return nil, fmt.Errorf("单机模式无缓存")
+}
+
+func (p *Provider) NodeClient(nodeType string) (panel.NodeClient, error) {
+	return &NodeClient{
+		provider: p,
+		nodeType: nodeType,
+	}, nil
+}
+
+// NodeClient serves the users of one node and writes its traffic reports.
+type NodeClient struct {
+	provider *Provider
+	nodeType string
+	version  int
+}
+
+// GetUserList returns the users, or nil when the file did not change since
+// the last call.
+func (c *NodeClient) GetUserList(_ context.Context) ([]panel.UserInfo, error) {
+	c.provider.access.RLock()
+	defer c.provider.access.RUnlock()
+	if c.version == c.provider.version {
+		return nil, nil
+	}
+	c.version = c.provider.version
+	users := make([]panel.UserInfo, len(c.provider.file.Users))
+	copy(users, c.provider.file.Users)
+	return users, nil
+}
+
+// GetCachedUserList is never used, GetUserList does not fail.
+func (c *NodeClient) GetCachedUserList() ([]panel.UserInfo, error) {
+	return nil, fmt.Errorf("单机模式无缓存")
+}
+
+func (c *NodeClient) GetUserAlive(_ context.Context) (map[int]int, error) {
+	return make(map[int]int), nil
+}
+
+func (c *NodeClient) ReportUserTraffic(_ context.Context, userTraffic *[]panel.UserTraffic) error {
+	body, err := json.Marshal(&TrafficRecord{
+		Time:    time.Now().Unix(),
+		Type:    c.nodeType,
+		Traffic: *userTraffic,
+	})
+	if err != nil {
+		return fmt.Errorf("encode traffic error: %s", err)
+	}
+	c.provider.access.Lock()
+	defer c.provider.access.Unlock()
+	if _, err := c.provider.output.Write(append(body, '\n')); err != nil {
+		return fmt.Errorf("write traffic error: %s", err)
+	}
+	return nil
+}
+
+func (c *NodeClient) ReportNodeOnlineUsers(_ context.Context, _ *[]panel.OnlineUser) error {
+	return nil
+}
+
+func (c *NodeClient) ReportUserThrottle(_ context.Context, _ *[]panel.ThrottleEvent) error {
+	return nil
+}
+
+func (c *NodeClient) ReportNodeStatus(_ context.Context, _ *panel.NodeStatus) error {
+	return nil
+}
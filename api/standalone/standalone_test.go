@@ -0,0 +1,82 @@
+package standalone
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+)
+
+func TestProviderServesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nodes.yml")
+	file := `
+protocols:
+  - type: vless
+    port: 10001
+    enable: true
+  - type: trojan
+    port: 10002
+users:
+  - id: 1
+    uuid: b831381d-6324-4d53-ad4f-8cda48b30811
+    speed_limit: 10
+`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(path, filepath.Join(dir, "traffic.jsonl"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer p.Close()
+
+	serverconfig := p.ServerConfig()
+	if len(*serverconfig.Data.Protocols) != 2 || serverconfig.Data.Total != 1 {
+		t.Fatalf("ServerConfig() = %+v, want 2 protocols, 1 enabled", serverconfig.Data)
+	}
+	if got, _ := p.GetServerConfig(context.Background()); got != nil {
+		t.Fatalf("GetServerConfig() = %+v, want nil for an unchanged file", got)
+	}
+
+	client, err := p.NodeClient("vless")
+	if err != nil {
+		t.Fatalf("NodeClient() error: %v", err)
+	}
+	users, err := client.GetUserList(context.Background())
+	if err != nil || len(users) != 1 || users[0].SpeedLimit != 10 {
+		t.Fatalf("GetUserList() = %+v, %v, want the user of the file", users, err)
+	}
+	if users, _ := client.GetUserList(context.Background()); users != nil {
+		t.Fatalf("GetUserList() = %+v, want nil for an unchanged file", users)
+	}
+
+	if err := p.Load(); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if got, _ := p.GetServerConfig(context.Background()); got == nil {
+		t.Fatal("GetServerConfig() = nil after a reload")
+	}
+	if users, _ := client.GetUserList(context.Background()); len(users) != 1 {
+		t.Fatalf("GetUserList() = %+v after a reload, want the user of the file", users)
+	}
+
+	traffic := []panel.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+	if err := client.ReportUserTraffic(context.Background(), &traffic); err != nil {
+		t.Fatalf("ReportUserTraffic() error: %v", err)
+	}
+	body, err := os.ReadFile(filepath.Join(dir, "traffic.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &TrafficRecord{}
+	if err := json.Unmarshal(body, record); err != nil {
+		t.Fatalf("traffic output %q: %v", body, err)
+	}
+	if record.Type != "vless" || len(record.Traffic) != 1 || record.Traffic[0] != traffic[0] {
+		t.Fatalf("traffic record = %+v, want %+v", record, traffic)
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/api/standalone"
+	"github.com/perfect-panel/ppanel-node/conf"
+	"github.com/perfect-panel/ppanel-node/core"
+	"github.com/spf13/cobra"
+)
+
+var serverConfigFile string
+
+var checkCommand = cobra.Command{
+	Use:   "check",
+	Short: "Check the config and dry-run the Xray build",
+	Run:   checkHandle,
+	Args:  cobra.NoArgs,
+}
+
+func init() {
+	checkCommand.Flags().
+		StringVarP(&config, "config", "c",
+			"/etc/PPanel-node/config.yml", "config file path")
+	checkCommand.Flags().
+		StringVarP(&serverConfigFile, "server-config", "s",
+			"", "read the server config from a json file instead of the panel")
+	command.AddCommand(&checkCommand)
+}
+
+func checkHandle(_ *cobra.Command, _ []string) {
+	c := conf.New()
+	if err := c.LoadFromPath(config); err != nil {
+		fmt.Println("读取配置文件失败:", err)
+		os.Exit(1)
+	}
+	serverconfig, err := loadServerConfig(c)
+	if err != nil {
+		fmt.Println("获取服务端配置失败:", err)
+		os.Exit(1)
+	}
+	errs := core.CheckConfig(c, serverconfig)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("发现 %d 个错误\n", len(errs))
+		os.Exit(1)
+	}
+	fmt.Printf("配置检查通过，共 %d 个协议\n", len(*serverconfig.Data.Protocols))
+}
+
+// loadServerConfig reads the server config from the file given on the
+// command line or the standalone file, or fetches it from the panel.
+func loadServerConfig(c *conf.Conf) (*panel.ServerConfigResponse, error) {
+	if serverConfigFile != "" {
+		body, err := os.ReadFile(serverConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		return panel.DecodeServerConfig(body)
+	}
+	if c.StandaloneConfig.Path != "" {
+		f, err := standalone.ReadFile(c.StandaloneConfig.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &panel.ServerConfigResponse{Data: &f.Data}, nil
+	}
+	return panel.New(&c.ApiConfig, "").GetServerConfig(context.Background())
+}
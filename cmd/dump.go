@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/perfect-panel/ppanel-node/conf"
+	"github.com/perfect-panel/ppanel-node/core"
+	"github.com/spf13/cobra"
+)
+
+var dumpOutput string
+
+var dumpCommand = cobra.Command{
+	Use:   "dump-config",
+	Short: "Print the effective Xray json config",
+	Run:   dumpHandle,
+	Args:  cobra.NoArgs,
+}
+
+func init() {
+	dumpCommand.Flags().
+		StringVarP(&config, "config", "c",
+			"/etc/PPanel-node/config.yml", "config file path")
+	dumpCommand.Flags().
+		StringVarP(&serverConfigFile, "server-config", "s",
+			"", "read the server config from a json file instead of the panel")
+	dumpCommand.Flags().
+		StringVarP(&dumpOutput, "output", "o",
+			"", "write the xray config to a file instead of stdout")
+	command.AddCommand(&dumpCommand)
+}
+
+func dumpHandle(_ *cobra.Command, _ []string) {
+	c := conf.New()
+	if err := c.LoadFromPath(config); err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置文件失败:", err)
+		os.Exit(1)
+	}
+	serverconfig, err := loadServerConfig(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "获取服务端配置失败:", err)
+		os.Exit(1)
+	}
+	xrayConfig, err := core.BuildXrayConfig(c, serverconfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "生成Xray配置失败:", err)
+		os.Exit(1)
+	}
+	data, err := core.MarshalXrayConfig(xrayConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "生成Xray配置失败:", err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if dumpOutput == "" {
+		_, _ = os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(dumpOutput, data, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "写入Xray配置失败:", err)
+		os.Exit(1)
+	}
+}
@@ -2,15 +2,21 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
+	"github.com/perfect-panel/ppanel-node/api/admin"
 	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/api/standalone"
+	"github.com/perfect-panel/ppanel-node/common/metrics"
 	"github.com/perfect-panel/ppanel-node/conf"
 	"github.com/perfect-panel/ppanel-node/core"
 	"github.com/perfect-panel/ppanel-node/limiter"
@@ -80,31 +86,62 @@ func serverHandle(_ *cobra.Command, _ []string) {
 			}
 		}()
 	}
+	if c.MetricsConfig.Listen != "" {
+		if err := metrics.Serve(c.MetricsConfig.Listen, c.MetricsConfig.Path); err != nil {
+			log.WithField("err", err).Error("启动监控指标服务失败")
+			return
+		}
+		log.Infof("Starting metrics server on %s", c.MetricsConfig.Listen)
+	}
 	limiter.Init()
-	p := panel.NewClientV2(&c.ApiConfig)
-	serverconfig, err := panel.GetServerConfig(context.Background(), p)
-	if err != nil {
-		log.WithField("err", err).Error("获取服务端配置失败")
-		return
+	var provider panel.Provider
+	var serverconfig *panel.ServerConfigResponse
+	if c.StandaloneConfig.Path != "" {
+		s, err := standalone.New(c.StandaloneConfig.Path, c.StandaloneConfig.Traffic)
+		if err != nil {
+			log.WithField("err", err).Error("读取单机配置失败")
+			return
+		}
+		defer s.Close()
+		if watch {
+			if err := s.Watch(); err != nil {
+				log.WithField("err", err).Error("start watch failed")
+				return
+			}
+		}
+		provider = s
+		serverconfig = s.ServerConfig()
+		log.Infof("单机模式，从 %s 读取节点配置", c.StandaloneConfig.Path)
+	} else {
+		provider = panel.New(&c.ApiConfig, filepath.Join(c.DataDir, "cache"))
+		serverconfig, err = getServerConfig(provider)
+		if err != nil {
+			log.WithField("err", err).Error("获取服务端配置失败")
+			return
+		}
 	}
 	var reloadCh = make(chan struct{}, 1)
-	xraycore := core.New(c, p)
-	xraycore.ReloadCh = reloadCh
-	err = xraycore.Start(serverconfig)
-	if err != nil {
-		log.WithField("err", err).Error("启动Xray核心失败")
-		return
+	var updateCh = make(chan *panel.ServerConfigResponse, 1)
+	var adminServer *admin.Server
+	if c.AdminConfig.Listen != "" {
+		adminServer = admin.New(c.AdminConfig.Token, reloadCh)
+		if err := adminServer.Serve(c.AdminConfig.Listen); err != nil {
+			log.WithField("err", err).Error("启动管理接口失败")
+			return
+		}
+		log.Infof("Starting admin api on %s", c.AdminConfig.Listen)
 	}
-	defer xraycore.Close()
-	nodes, err := node.New(xraycore, c, serverconfig)
+	xraycore := core.New(c, provider)
+	xraycore.ReloadCh = reloadCh
+	xraycore.UpdateCh = updateCh
+	nodes, err := start(xraycore, serverconfig)
 	if err != nil {
-		log.WithField("err", err).Error("获取节点配置失败")
+		log.WithFields(startErrorFields(err)).Error("启动失败")
 		return
 	}
-	err = nodes.Start()
-	if err != nil {
-		log.WithField("err", err).Error("启动节点失败")
-		return
+	metrics.SetSource(nodes)
+	if adminServer != nil {
+		adminServer.SetNode(nodes)
 	}
 	log.Infof("已启动 %d 个节点", serverconfig.Data.Total)
 	if watch {
@@ -129,7 +166,10 @@ func serverHandle(_ *cobra.Command, _ []string) {
 	for {
 		select {
 		case <-osSignals:
-			nodes.Close()
+			log.Info("收到退出信号，正在关闭节点...")
+			if err := nodes.Shutdown(time.Duration(c.GracePeriod) * time.Second); err != nil {
+				log.WithField("err", err).Error("关闭节点失败")
+			}
 			_ = xraycore.Close()
 			return
 		case <-reloadCh:
@@ -137,51 +177,173 @@ func serverHandle(_ *cobra.Command, _ []string) {
 			if err := reload(config, &nodes, &xraycore); err != nil {
 				log.WithField("err", err).Error("重启失败")
 			}
+			if adminServer != nil {
+				adminServer.SetNode(nodes)
+			}
+		case serverconfig := <-updateCh:
+			if err := update(serverconfig, nodes, xraycore); err != nil {
+				log.WithField("err", err).Warn("增量更新失败，正在重新加载配置...")
+				if err := reload(config, &nodes, &xraycore); err != nil {
+					log.WithField("err", err).Error("重启失败")
+				}
+				if adminServer != nil {
+					adminServer.SetNode(nodes)
+				}
+			}
 		}
 	}
 }
 
-func reload(config string, nodes **node.Node, xcore **core.XrayCore) error {
-	// Preserve old reload channel so new core continues to receive signals
-	var oldReloadCh chan struct{}
-
-	if *xcore != nil {
-		oldReloadCh = (*xcore).ReloadCh
+// getServerConfig fetches the server config from the panel and falls back
+// to the cached one when the panel is unreachable. The monitor task picks up
+// the current config once the panel is back.
+func getServerConfig(p panel.Provider) (*panel.ServerConfigResponse, error) {
+	serverconfig, err := p.GetServerConfig(context.Background())
+	if err == nil {
+		return serverconfig, nil
+	}
+	serverconfig, cerr := p.GetCachedServerConfig()
+	if cerr != nil {
+		return nil, err
 	}
+	log.WithField("err", err).Warn("获取服务端配置失败，使用本地缓存")
+	return serverconfig, nil
+}
 
-	(*nodes).Close()
-	if err := (*xcore).Close(); err != nil {
+// update applies a changed server config to the running core and nodes
+// without restarting the Xray instance.
+func update(serverconfig *panel.ServerConfigResponse, nodes *node.Node, xcore *core.XrayCore) error {
+	if err := xcore.Update(serverconfig); err != nil {
+		return err
+	}
+	if err := nodes.Update(serverconfig); err != nil {
 		return err
 	}
+	log.Infof("%d 个节点更新成功", serverconfig.Data.Total)
+	return nil
+}
 
+// reload restarts the core and nodes with the current config file and server
+// config. The new config is built and validated before anything is closed,
+// so a bad config keeps the running instance serving. The running nodes are
+// shut down gracefully. When the new config fails to start, the previous one
+// is started again.
+func reload(config string, nodes **node.Node, xcore **core.XrayCore) error {
 	newConf := conf.New()
 	if err := newConf.LoadFromPath(config); err != nil {
 		return err
 	}
-	p := panel.NewClientV2(&newConf.ApiConfig)
-	serverconfig, err := panel.GetServerConfig(context.Background(), p)
-	if err != nil {
-		log.WithField("err", err).Error("获取服务端配置失败")
-		return err
+	var provider panel.Provider
+	var serverconfig *panel.ServerConfigResponse
+	s, standaloneRunning := (*xcore).Provider.(*standalone.Provider)
+	if standaloneRunning || newConf.StandaloneConfig.Path != "" {
+		// The file is watched by the provider, it lives as long as the process
+		if !standaloneRunning || s.Path() != newConf.StandaloneConfig.Path {
+			return errors.New("切换单机模式或其配置文件需要重启进程")
+		}
+		provider = s
+		serverconfig = s.ServerConfig()
+	} else {
+		provider = panel.New(&newConf.ApiConfig, filepath.Join(newConf.DataDir, "cache"))
+		var err error
+		serverconfig, err = getServerConfig(provider)
+		if err != nil {
+			log.WithField("err", err).Error("获取服务端配置失败")
+			return err
+		}
+	}
+	if err := core.ValidateConfig(newConf, serverconfig); err != nil {
+		return fmt.Errorf("新配置无效，继续使用当前配置: %w", err)
 	}
 
-	newCore := core.New(newConf, p)
-	// Reattach reload channel
-	newCore.ReloadCh = oldReloadCh
-	if err := newCore.Start(serverconfig); err != nil {
-		return err
+	// Keep the running config to roll back to, Close clears it
+	oldCore := core.New((*xcore).Config, (*xcore).Provider)
+	oldServerConfig := (*xcore).ServerConfig()
+	// Preserve old reload channels so new core continues to receive signals
+	oldCore.ReloadCh = (*xcore).ReloadCh
+	oldCore.UpdateCh = (*xcore).UpdateCh
+
+	// Established connections get the grace period of the running config
+	// to finish and their traffic is reported, as on exit
+	grace := time.Duration((*xcore).Config.GracePeriod) * time.Second
+	if err := (*nodes).Shutdown(grace); err != nil {
+		log.WithField("err", err).Error("关闭节点失败")
 	}
-	newNodes, err := node.New(newCore, newConf, serverconfig)
-	if err != nil {
+	if err := (*xcore).Close(); err != nil {
 		return err
 	}
-	if err := newNodes.Start(); err != nil {
-		return err
+
+	newCore := core.New(newConf, provider)
+	newCore.ReloadCh = oldCore.ReloadCh
+	newCore.UpdateCh = oldCore.UpdateCh
+	newNodes, err := start(newCore, serverconfig)
+	if err != nil {
+		// start closed what it had started, it never accepted a connection,
+		// so there is nothing to drain before rolling back
+		log.WithFields(startErrorFields(err)).Error("启动新配置失败，正在恢复之前的配置...")
+		newNodes, rerr := start(oldCore, oldServerConfig)
+		if rerr != nil {
+			return errors.Join(err, fmt.Errorf("恢复之前的配置失败: %w", rerr))
+		}
+		*nodes = newNodes
+		*xcore = oldCore
+		metrics.SetSource(newNodes)
+		log.Warnf("已恢复之前的配置，%d 个节点已启动", oldServerConfig.Data.Total)
+		return fmt.Errorf("新配置启动失败，已恢复之前的配置: %w", err)
 	}
 
 	*nodes = newNodes
 	*xcore = newCore
+	metrics.SetSource(newNodes)
+	// Drop an update queued by the old core, the fetched config is newer
+	select {
+	case <-newCore.UpdateCh:
+	default:
+	}
 	log.Infof("%d 个节点重启成功", serverconfig.Data.Total)
 	runtime.GC()
 	return nil
 }
+
+// startErrorFields returns the log fields of an error of start. Errors of
+// the server config carry their location, failures of the Xray instance
+// with a valid config are told apart from them.
+func startErrorFields(err error) log.Fields {
+	var ce *core.ConfigError
+	switch {
+	case errors.As(err, &ce):
+		return log.Fields{
+			"cause":   "config",
+			"section": ce.Section,
+			"index":   ce.Index,
+			"field":   ce.Field,
+			"err":     err,
+		}
+	case errors.Is(err, core.ErrInstance):
+		return log.Fields{
+			"cause": "instance",
+			"err":   err,
+		}
+	}
+	return log.Fields{"err": err}
+}
+
+// start starts xcore and its nodes for serverconfig. On failure everything
+// started is closed again.
+func start(xcore *core.XrayCore, serverconfig *panel.ServerConfigResponse) (*node.Node, error) {
+	if err := xcore.Start(serverconfig); err != nil {
+		_ = xcore.Close()
+		return nil, fmt.Errorf("启动Xray核心失败: %w", err)
+	}
+	nodes, err := node.New(xcore, xcore.Config, serverconfig)
+	if err != nil {
+		_ = xcore.Close()
+		return nil, fmt.Errorf("获取节点配置失败: %w", err)
+	}
+	if err := nodes.Start(); err != nil {
+		_ = nodes.Close()
+		_ = xcore.Close()
+		return nil, fmt.Errorf("启动节点失败: %w", err)
+	}
+	return nodes, nil
+}
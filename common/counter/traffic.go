@@ -7,11 +7,17 @@ import (
 
 type TrafficCounter struct {
 	Counters sync.Map
+	// UpTotal and DownTotal are never reset, unlike the user counters
+	UpTotal   atomic.Int64
+	DownTotal atomic.Int64
 }
 
 type TrafficStorage struct {
 	UpCounter   atomic.Int64
 	DownCounter atomic.Int64
+	// UpTotal and DownTotal are never reset, unlike UpCounter and DownCounter
+	UpTotal   atomic.Int64
+	DownTotal atomic.Int64
 }
 
 func NewTrafficCounter() *TrafficCounter {
@@ -64,11 +70,25 @@ func (c *TrafficCounter) Delete(uuid string) {
 }
 
 func (c *TrafficCounter) Rx(uuid string, n int) {
-	cts := c.GetCounter(uuid)
-	cts.DownCounter.Add(int64(n))
+	c.DownStats(c.GetCounter(uuid)).Add(int64(n))
 }
 
 func (c *TrafficCounter) Tx(uuid string, n int) {
-	cts := c.GetCounter(uuid)
-	cts.UpCounter.Add(int64(n))
+	c.UpStats(c.GetCounter(uuid)).Add(int64(n))
+}
+
+// UpStats returns the stats counter for the upload traffic of cts.
+func (c *TrafficCounter) UpStats(cts *TrafficStorage) *XrayTrafficCounter {
+	return &XrayTrafficCounter{
+		V:      &cts.UpCounter,
+		Totals: []*atomic.Int64{&cts.UpTotal, &c.UpTotal},
+	}
+}
+
+// DownStats returns the stats counter for the download traffic of cts.
+func (c *TrafficCounter) DownStats(cts *TrafficStorage) *XrayTrafficCounter {
+	return &XrayTrafficCounter{
+		V:      &cts.DownCounter,
+		Totals: []*atomic.Int64{&cts.DownTotal, &c.DownTotal},
+	}
 }
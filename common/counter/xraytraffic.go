@@ -10,6 +10,8 @@ var _ fstats.Counter = (*XrayTrafficCounter)(nil)
 
 type XrayTrafficCounter struct {
 	V *atomic.Int64
+	// Totals are added to along with V but not affected by Set
+	Totals []*atomic.Int64
 }
 
 func (c *XrayTrafficCounter) Value() int64 {
@@ -21,5 +23,8 @@ func (c *XrayTrafficCounter) Set(newValue int64) int64 {
 }
 
 func (c *XrayTrafficCounter) Add(delta int64) int64 {
+	for _, t := range c.Totals {
+		t.Add(delta)
+	}
 	return c.V.Add(delta)
 }
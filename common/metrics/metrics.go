@@ -0,0 +1,133 @@
+// Package metrics exposes the node state as Prometheus metrics.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "ppnode"
+
+var (
+	PanelRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "panel",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of panel API requests, of the last attempt when retried.",
+	}, []string{"endpoint"})
+	PanelRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "panel",
+		Name:      "request_errors_total",
+		Help:      "Panel API requests that failed or got an error status.",
+	}, []string{"endpoint"})
+	LinksRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "limiter",
+		Name:      "rejected_links_total",
+		Help:      "Connections refused by a device, quota or connection limit.",
+	}, []string{"tag", "reason"})
+	TaskLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "task",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful run of a periodic task.",
+	}, []string{"task", "tag"})
+)
+
+// Descriptors of the metrics read from the running node at scrape time.
+var (
+	TrafficBytesDesc = prometheus.NewDesc(
+		namespace+"_traffic_bytes_total",
+		"Bytes transferred through an inbound.",
+		[]string{"tag", "direction"}, nil)
+	UserTrafficBytesDesc = prometheus.NewDesc(
+		namespace+"_user_traffic_bytes_total",
+		"Bytes transferred by a user through an inbound.",
+		[]string{"tag", "uid", "direction"}, nil)
+	UserOnlineIPsDesc = prometheus.NewDesc(
+		namespace+"_user_online_ips",
+		"Number of IPs a user is online with.",
+		[]string{"tag", "uid"}, nil)
+	UserActiveLinksDesc = prometheus.NewDesc(
+		namespace+"_user_active_links",
+		"Number of open connections of a user.",
+		[]string{"tag", "uid"}, nil)
+	CertExpiryDaysDesc = prometheus.NewDesc(
+		namespace+"_cert_expiry_days",
+		"Days until the certificate of an inbound expires.",
+		[]string{"tag"}, nil)
+)
+
+// Source collects the metrics of the running node.
+type Source interface {
+	Collect(ch chan<- prometheus.Metric)
+}
+
+type sourceCollector struct {
+	access sync.RWMutex
+	source Source
+}
+
+func (c *sourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- TrafficBytesDesc
+	ch <- UserTrafficBytesDesc
+	ch <- UserOnlineIPsDesc
+	ch <- UserActiveLinksDesc
+	ch <- CertExpiryDaysDesc
+}
+
+func (c *sourceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	if c.source != nil {
+		c.source.Collect(ch)
+	}
+}
+
+var (
+	registry = prometheus.NewRegistry()
+	source   = &sourceCollector{}
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PanelRequestDuration,
+		PanelRequestErrors,
+		LinksRejected,
+		TaskLastSuccess,
+		source,
+	)
+}
+
+// SetSource replaces the node read at scrape time, nil removes it.
+func SetSource(s Source) {
+	source.access.Lock()
+	source.source = s
+	source.access.Unlock()
+}
+
+// Serve starts the metrics endpoint. It returns once listen is bound.
+func Serve(listen string, path string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("listen metrics error: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.WithField("err", err).Error("metrics server failed")
+		}
+	}()
+	return nil
+}
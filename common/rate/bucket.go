@@ -0,0 +1,144 @@
+package rate
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// Limiter delays a writer until it may write count bytes.
+type Limiter interface {
+	Wait(count int64)
+}
+
+// Limiters waits on each of its limiters in turn.
+type Limiters []Limiter
+
+func (l Limiters) Wait(count int64) {
+	for _, limiter := range l {
+		limiter.Wait(count)
+	}
+}
+
+// Allowance lets the first bytes through without waiting on its limiter.
+type Allowance struct {
+	limiter Limiter
+	left    atomic.Int64
+}
+
+// NewAllowance returns a limiter letting n bytes through at full speed
+// before waiting on limiter.
+func NewAllowance(n int64, limiter Limiter) *Allowance {
+	a := &Allowance{limiter: limiter}
+	a.left.Store(n)
+	return a
+}
+
+func (a *Allowance) Wait(count int64) {
+	if a.left.Load() > 0 {
+		left := a.left.Add(-count)
+		if left >= 0 {
+			return
+		}
+		// Wait only for what the allowance did not cover
+		count = min(-left, count)
+	}
+	a.limiter.Wait(count)
+}
+
+// Bucket is a token bucket whose rate can be changed while writers use it.
+// The tokens already taken are carried over, so a change grants no burst.
+// A bucket of rate zero is unlimited, it can be limited later.
+type Bucket struct {
+	access   sync.Mutex
+	bucket   atomic.Pointer[ratelimit.Bucket] // nil when unlimited
+	rate     int64
+	capacity int64
+	interval time.Duration
+}
+
+// NewBucket returns a bucket filled with rate bytes per second, holding at
+// most capacity bytes. It is unlimited when rate is zero.
+func NewBucket(rate, capacity int64) *Bucket {
+	return NewBucketWithInterval(0, rate, capacity)
+}
+
+// NewBucketWithInterval returns a bucket filled with rate bytes per second
+// every interval, or continuously when interval is zero, holding at most
+// capacity bytes. It is unlimited when rate is zero.
+func NewBucketWithInterval(interval time.Duration, rate, capacity int64) *Bucket {
+	b := &Bucket{
+		interval: interval,
+	}
+	b.SetRate(rate, capacity)
+	return b
+}
+
+func (b *Bucket) fill(rate, capacity int64) *ratelimit.Bucket {
+	if b.interval > 0 {
+		quantum := max(int64(float64(rate)*b.interval.Seconds()), 1)
+		return ratelimit.NewBucketWithQuantum(b.interval, capacity, quantum)
+	}
+	return ratelimit.NewBucketWithRate(float64(rate), capacity)
+}
+
+func (b *Bucket) Wait(count int64) {
+	if bucket := b.bucket.Load(); bucket != nil {
+		bucket.Wait(count)
+	}
+}
+
+// Rate returns the rate of the bucket in bytes per second, zero when it is
+// unlimited.
+func (b *Bucket) Rate() int64 {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.rate
+}
+
+// Capacity returns the bytes the bucket holds at most.
+func (b *Bucket) Capacity() int64 {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.capacity
+}
+
+// Available returns the bytes in the bucket, negative when writers owe it
+// and zero when it is unlimited.
+func (b *Bucket) Available() int64 {
+	if bucket := b.bucket.Load(); bucket != nil {
+		return bucket.Available()
+	}
+	return 0
+}
+
+// SetRate changes the rate and capacity of the bucket, a zero rate makes it
+// unlimited.
+func (b *Bucket) SetRate(rate, capacity int64) {
+	if rate <= 0 {
+		rate, capacity = 0, 0
+	} else {
+		capacity = max(capacity, 1)
+	}
+	b.access.Lock()
+	defer b.access.Unlock()
+	if rate == b.rate && capacity == b.capacity {
+		return
+	}
+	old := b.bucket.Load()
+	b.rate = rate
+	b.capacity = capacity
+	if rate == 0 {
+		b.bucket.Store(nil)
+		return
+	}
+	bucket := b.fill(rate, capacity)
+	if old != nil {
+		// Take what is missing from the old bucket, including what waiting
+		// writers owe it
+		bucket.Take(capacity - min(old.Available(), capacity))
+	}
+	b.bucket.Store(bucket)
+}
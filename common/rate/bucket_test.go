@@ -0,0 +1,33 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketUnlimited(t *testing.T) {
+	b := NewBucket(0, 0)
+	start := time.Now()
+	b.Wait(1 << 30)
+	if time.Since(start) > 100*time.Millisecond || b.Rate() != 0 {
+		t.Fatalf("Wait() took %v at rate %d, want no wait", time.Since(start), b.Rate())
+	}
+
+	// A limit set later applies to the writers of the bucket
+	b.SetRate(1000, 1000)
+	if got := b.Available(); got != 1000 {
+		t.Fatalf("available = %d after the limit, want a full bucket", got)
+	}
+	start = time.Now()
+	b.Wait(1500)
+	if time.Since(start) < 400*time.Millisecond {
+		t.Fatalf("Wait() took %v, want the writer held back", time.Since(start))
+	}
+
+	b.SetRate(0, 0)
+	start = time.Now()
+	b.Wait(1 << 30)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("Wait() took %v after the limit was removed, want no wait", time.Since(start))
+	}
+}
@@ -0,0 +1,159 @@
+package rate
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shareInterval is how often the rate of a group is shared again.
+	shareInterval = time.Second
+	// memberIdleAfter is how long a member without traffic is kept.
+	memberIdleAfter = time.Minute
+	// minShare is the smallest rate of a member in bytes per second.
+	minShare = 16 << 10
+)
+
+// Group shares a rate fairly between its members. Each second, members that
+// used less than an even share get a little more than they used and the rest
+// is split evenly between the others, so no member can starve the group.
+type Group struct {
+	access  sync.Mutex
+	rate    int64
+	members map[string]*Member
+	shared  time.Time
+	next    atomic.Int64 // unix nano of the next share
+}
+
+// Member is a Limiter taking its share of the rate of its group.
+type Member struct {
+	group   *Group
+	key     string
+	bucket  *Bucket
+	used    atomic.Int64
+	removed atomic.Bool
+	active  time.Time
+}
+
+// NewGroup returns a group sharing rate bytes per second.
+func NewGroup(rate int64) *Group {
+	now := time.Now()
+	g := &Group{
+		rate:    rate,
+		members: make(map[string]*Member),
+		shared:  now,
+	}
+	g.next.Store(now.Add(shareInterval).UnixNano())
+	return g
+}
+
+// Rate returns the rate of the group in bytes per second.
+func (g *Group) Rate() int64 {
+	g.access.Lock()
+	defer g.access.Unlock()
+	return g.rate
+}
+
+// SetRate changes the rate of the group, it is shared again on the next write.
+func (g *Group) SetRate(rate int64) {
+	g.access.Lock()
+	g.rate = rate
+	g.access.Unlock()
+	g.next.Store(0)
+}
+
+// Member returns the member key of the group, it is added when missing.
+func (g *Group) Member(key string) *Member {
+	g.access.Lock()
+	defer g.access.Unlock()
+	m, ok := g.members[key]
+	if !ok {
+		share := g.rate / int64(len(g.members)+1)
+		m = &Member{
+			group:  g,
+			key:    key,
+			bucket: NewBucket(max(share, 1), capacity(share)),
+		}
+		g.members[key] = m
+	}
+	m.active = time.Now()
+	return m
+}
+
+func (m *Member) Wait(count int64) {
+	m.used.Add(count)
+	g := m.group
+	if m.removed.Load() {
+		g.access.Lock()
+		if _, ok := g.members[m.key]; !ok {
+			m.removed.Store(false)
+			m.active = time.Now()
+			g.members[m.key] = m
+		}
+		g.access.Unlock()
+	}
+	now := time.Now()
+	if next := g.next.Load(); now.UnixNano() >= next && g.next.CompareAndSwap(next, now.Add(shareInterval).UnixNano()) {
+		g.access.Lock()
+		g.share(now)
+		g.access.Unlock()
+	}
+	m.bucket.Wait(count)
+}
+
+// share shares the rate between the members by what they used since the
+// last share. It must be called with access held.
+func (g *Group) share(now time.Time) {
+	window := now.Sub(g.shared)
+	g.shared = now
+	if window <= 0 {
+		return
+	}
+	type demand struct {
+		member *Member
+		usage  int64 // bytes per second
+	}
+	var active []demand
+	var idle []*Member
+	for key, m := range g.members {
+		used := m.used.Swap(0)
+		if used > 0 {
+			m.active = now
+			active = append(active, demand{m, used * int64(time.Second) / int64(window)})
+			continue
+		}
+		if now.Sub(m.active) > memberIdleAfter {
+			delete(g.members, key)
+			m.removed.Store(true)
+			continue
+		}
+		idle = append(idle, m)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].usage < active[j].usage
+	})
+	remaining := g.rate
+	for i, d := range active {
+		share := remaining / int64(len(active)-i)
+		// Members using nearly all of their share may use more, the
+		// others get a quarter more than they used
+		if d.usage < d.member.bucket.Rate()*9/10 {
+			share = min(share, max(d.usage*5/4, minShare))
+		}
+		// A bucket of rate zero is unlimited, a member always gets some
+		d.member.bucket.SetRate(max(share, 1), capacity(share))
+		remaining -= share
+	}
+	// Idle members start with an even share
+	share := g.rate / int64(len(active)+1)
+	for _, m := range idle {
+		m.bucket.SetRate(max(share, 1), capacity(share))
+	}
+}
+
+// capacity returns the burst of a share, a tenth of a second of it.
+func capacity(share int64) int64 {
+	return max(share/10, minShare)
+}
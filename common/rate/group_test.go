@@ -0,0 +1,54 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupSharesFairly(t *testing.T) {
+	g := NewGroup(1000 << 10)
+	light := g.Member("light")
+	heavy := g.Member("heavy")
+	idle := g.Member("idle")
+
+	// Both used all they could, the light member is limited elsewhere
+	light.used.Store(100 << 10)
+	heavy.used.Store(light.bucket.Rate())
+	g.share(g.shared.Add(time.Second))
+	if got, want := light.bucket.Rate(), int64(125<<10); got != want {
+		t.Fatalf("light rate = %d, want %d", got, want)
+	}
+	if got, want := heavy.bucket.Rate(), int64(1000<<10-125<<10); got != want {
+		t.Fatalf("heavy rate = %d, want the rest %d", got, want)
+	}
+	if got, want := idle.bucket.Rate(), int64(1000<<10/3); got != want {
+		t.Fatalf("idle rate = %d, want an even share %d", got, want)
+	}
+
+	// The light member needs more, it gets an even share again
+	light.used.Store(light.bucket.Rate())
+	heavy.used.Store(heavy.bucket.Rate())
+	g.share(g.shared.Add(time.Second))
+	if light.bucket.Rate() != 500<<10 || heavy.bucket.Rate() != 500<<10 {
+		t.Fatalf("rates = %d, %d, want even shares", light.bucket.Rate(), heavy.bucket.Rate())
+	}
+
+	g.SetRate(2000 << 10)
+	g.share(g.shared.Add(time.Second))
+	if got := idle.bucket.Rate(); got != 2000<<10 {
+		t.Fatalf("idle rate = %d after SetRate, want the whole rate", got)
+	}
+}
+
+func TestGroupRemovesIdleMembers(t *testing.T) {
+	g := NewGroup(1000 << 10)
+	m := g.Member("user")
+	g.share(g.shared.Add(memberIdleAfter + time.Second))
+	if _, ok := g.members["user"]; ok || !m.removed.Load() {
+		t.Fatal("idle member kept")
+	}
+	m.Wait(1)
+	if g.members["user"] != m {
+		t.Fatal("member not added again on use")
+	}
+}
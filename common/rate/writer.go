@@ -1,17 +1,16 @@
 package rate
 
 import (
-	"github.com/juju/ratelimit"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 )
 
 type Writer struct {
 	writer  buf.Writer
-	limiter *ratelimit.Bucket
+	limiter Limiter
 }
 
-func NewRateLimitWriter(writer buf.Writer, limiter *ratelimit.Bucket) buf.Writer {
+func NewRateLimitWriter(writer buf.Writer, limiter Limiter) buf.Writer {
 	return &Writer{
 		writer:  writer,
 		limiter: limiter,
@@ -26,3 +25,28 @@ func (w *Writer) WriteMultiBuffer(mb buf.MultiBuffer) error {
 	w.limiter.Wait(int64(mb.Len()))
 	return w.writer.WriteMultiBuffer(mb)
 }
+
+// Reader limits the rate of the buffers read from reader.
+type Reader struct {
+	reader  buf.Reader
+	limiter Limiter
+}
+
+func NewRateLimitReader(reader buf.Reader, limiter Limiter) buf.Reader {
+	return &Reader{
+		reader:  reader,
+		limiter: limiter,
+	}
+}
+
+func (r *Reader) Interrupt() {
+	common.Interrupt(r.reader)
+}
+
+func (r *Reader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.reader.ReadMultiBuffer()
+	if !mb.IsEmpty() {
+		r.limiter.Wait(int64(mb.Len()))
+	}
+	return mb, err
+}
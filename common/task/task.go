@@ -6,11 +6,21 @@ import (
 	"sync"
 	"time"
 
+	"github.com/perfect-panel/ppanel-node/common/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrFailed is returned by Execute for a failed run which has been handled
+// already. Unlike other errors it does not stop the task.
+var ErrFailed = errors.New("task run failed")
+
+// ErrTimeout is returned by ExecuteWithTimeout when a run timed out and no
+// reload can be requested to recover from it.
+var ErrTimeout = errors.New("task execution timed out")
+
 type Task struct {
 	Name     string
+	Tag      string
 	Interval time.Duration
 	Execute  func(context.Context) error
 	Access   sync.RWMutex
@@ -33,6 +43,7 @@ func (t *Task) Start(first bool) error {
 		defer timer.Stop()
 		if first {
 			if err := t.ExecuteWithTimeout(); err != nil {
+				log.Errorf("Task %s execution error: %v", t.Name, err)
 				return
 			}
 		}
@@ -67,20 +78,22 @@ func (t *Task) ExecuteWithTimeout() error {
 
 	select {
 	case <-ctx.Done():
+		if t.ReloadCh == nil {
+			return ErrTimeout
+		}
 		log.Errorf("Task %s execution timed out, reloading", t.Name)
-		if t.ReloadCh != nil {
-			select {
-			case t.ReloadCh <- struct{}{}:
-			default:
-			}
-		} else {
-			log.Panic("Reload failed")
+		select {
+		case t.ReloadCh <- struct{}{}:
+		default:
 		}
 		return nil
 	case err := <-done:
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if errors.Is(err, ErrFailed) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			return nil
 		}
+		if err == nil {
+			metrics.TaskLastSuccess.WithLabelValues(t.Name, t.Tag).SetToCurrentTime()
+		}
 		return err
 	}
 }
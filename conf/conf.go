@@ -3,14 +3,21 @@ package conf
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Conf struct {
-	LogConfig LogConfig       `mapstructure:"Log"`
-	ApiConfig ServerApiConfig `mapstructure:"Api"`
-	PprofPort int             `mapstructure:"PprofPort"`
+	LogConfig        LogConfig        `mapstructure:"Log"`
+	ApiConfig        ServerApiConfig  `mapstructure:"Api"`
+	StandaloneConfig StandaloneConfig `mapstructure:"Standalone"`
+	MetricsConfig    MetricsConfig    `mapstructure:"Metrics"`
+	AdminConfig      AdminConfig      `mapstructure:"Admin"`
+	LimitConfig      LimitConfig      `mapstructure:"Limit"`
+	PprofPort        int              `mapstructure:"PprofPort"`
+	DataDir          string           `mapstructure:"DataDir"`
+	GracePeriod      int              `mapstructure:"GracePeriod"`
 }
 
 type LogConfig struct {
@@ -19,19 +26,121 @@ type LogConfig struct {
 	Access string `mapstructure:"Access"`
 }
 
+// StandaloneConfig runs the node without a panel, disabled when Path is
+// empty. Protocols and users are read from the yaml or json file at Path and
+// traffic is written as json lines to the file Traffic, or to stdout.
+type StandaloneConfig struct {
+	Path    string `mapstructure:"Path"`
+	Traffic string `mapstructure:"Traffic"`
+}
+
+// MetricsConfig is the Prometheus metrics endpoint, disabled when Listen is empty.
+type MetricsConfig struct {
+	Listen string `mapstructure:"Listen"`
+	Path   string `mapstructure:"Path"`
+}
+
+// AdminConfig is the local admin API, disabled when Listen is empty. Every
+// request must carry Token as a bearer token.
+type AdminConfig struct {
+	Listen string `mapstructure:"Listen"`
+	Token  string `mapstructure:"Token"`
+}
+
+// LimitConfig is how the node limits its users. Speeds are in Mbps and sizes
+// in MB, the README has an example with the details.
+type LimitConfig struct {
+	// SpeedLimit is the speed of the machine, shared fairly by all users
+	SpeedLimit int `mapstructure:"SpeedLimit"`
+	// UpSpeedLimit and DownSpeedLimit lower SpeedLimit for one direction
+	UpSpeedLimit   int `mapstructure:"UpSpeedLimit"`
+	DownSpeedLimit int `mapstructure:"DownSpeedLimit"`
+	// QuotaSpeedLimit throttles users over their quota, cut off when zero
+	QuotaSpeedLimit int `mapstructure:"QuotaSpeedLimit"`
+	// DynamicRules cap users breaking them, the first match applies
+	DynamicRules []DynamicRule `mapstructure:"DynamicRules"`
+	// ReportThrottle pushes the capped users to the panel
+	ReportThrottle bool `mapstructure:"ReportThrottle"`
+	// ConnLimit and IPConnLimit cap the open connections of a user, in
+	// total and from one IP
+	ConnLimit   int `mapstructure:"ConnLimit"`
+	IPConnLimit int `mapstructure:"IPConnLimit"`
+	// Burst is the size of the speed limit bucket, one second when zero
+	Burst int `mapstructure:"Burst"`
+	// RefillInterval is how often the bucket is refilled, a second when zero
+	RefillInterval time.Duration `mapstructure:"RefillInterval"`
+	// FullSpeed is how much of each connection is not speed limited
+	FullSpeed int `mapstructure:"FullSpeed"`
+
+	// DevicePolicy is "reject" or "evict" for a new device over the limit
+	DevicePolicy string `mapstructure:"DevicePolicy"`
+	// DeviceGrace is how long an evicted device keeps its connections
+	DeviceGrace time.Duration `mapstructure:"DeviceGrace"`
+	// DeviceIPv4Prefix and DeviceIPv6Prefix count a network as one device
+	DeviceIPv4Prefix int `mapstructure:"DeviceIPv4Prefix"`
+	DeviceIPv6Prefix int `mapstructure:"DeviceIPv6Prefix"`
+
+	// Schedules lower the speed limits at times of day
+	Schedules []SpeedSchedule `mapstructure:"Schedules"`
+}
+
+// SpeedSchedule lowers speed limits every day from Start to End, local times
+// such as "20:00" and "23:00", an End before Start is on the next day. The
+// speed limits of the users in Groups, all users when empty, are scaled to
+// Percent and capped at SpeedLimit Mbps. TotalSpeedLimit caps all users
+// together. Zero values do not lower a limit.
+type SpeedSchedule struct {
+	Start           string   `mapstructure:"Start"`
+	End             string   `mapstructure:"End"`
+	Groups          []string `mapstructure:"Groups"`
+	Percent         int      `mapstructure:"Percent"`
+	SpeedLimit      int      `mapstructure:"SpeedLimit"`
+	TotalSpeedLimit int      `mapstructure:"TotalSpeedLimit"`
+}
+
+// DynamicRule caps a user at SpeedLimit Mbps for Duration once the user has
+// been over Speed Mbps, or had more than Connections open links, for Period.
+// Speed and Connections are not checked when zero.
+type DynamicRule struct {
+	Speed       int           `mapstructure:"Speed"`
+	Connections int           `mapstructure:"Connections"`
+	Period      time.Duration `mapstructure:"Period"`
+	SpeedLimit  int           `mapstructure:"SpeedLimit"`
+	Duration    time.Duration `mapstructure:"Duration"`
+}
+
+// ServerApiConfig is the panel API. AliveInterval is how often in seconds
+// the alive list of the users is fetched, it is not fetched when zero.
 type ServerApiConfig struct {
-	ApiHost   string `mapstructure:"ApiHost"`
-	ServerId  int    `mapstructure:"ServerID"`
-	SecretKey string `mapstructure:"SecretKey"`
-	Timeout   int    `mapstructure:"Timeout"`
+	ApiHost       string      `mapstructure:"ApiHost"`
+	ServerId      int         `mapstructure:"ServerID"`
+	SecretKey     string      `mapstructure:"SecretKey"`
+	Timeout       int         `mapstructure:"Timeout"`
+	AliveInterval int         `mapstructure:"AliveInterval"`
+	Retry         RetryConfig `mapstructure:"Retry"`
 }
 
 type NodeApiConfig struct {
-	APIHost   string `mapstructure:"ApiHost"`
-	NodeID    int    `mapstructure:"NodeID"`
-	SecretKey string `mapstructure:"SecretKey"`
-	NodeType  string `mapstructure:"NodeType"`
-	Timeout   int    `mapstructure:"Timeout"`
+	APIHost   string      `mapstructure:"ApiHost"`
+	NodeID    int         `mapstructure:"NodeID"`
+	SecretKey string      `mapstructure:"SecretKey"`
+	NodeType  string      `mapstructure:"NodeType"`
+	Timeout   int         `mapstructure:"Timeout"`
+	Retry     RetryConfig `mapstructure:"Retry"`
+}
+
+// RetryConfig is the retry policy of the panel API clients. Retries only
+// apply to GET requests, and to pushes when IdempotentPushes is set.
+type RetryConfig struct {
+	MaxAttempts int           `mapstructure:"MaxAttempts"`
+	BaseBackoff time.Duration `mapstructure:"BaseBackoff"`
+	MaxBackoff  time.Duration `mapstructure:"MaxBackoff"`
+	Jitter      float64       `mapstructure:"Jitter"`
+	StatusCodes []int         `mapstructure:"StatusCodes"`
+	// IdempotentPushes is set when the panel drops pushes carrying an
+	// Idempotency-Key it already accepted. Otherwise a failed push is not
+	// retried, its traffic is pushed again with the next report.
+	IdempotentPushes bool `mapstructure:"IdempotentPushes"`
 }
 
 func New() *Conf {
@@ -41,6 +150,20 @@ func New() *Conf {
 			Output: "",
 			Access: "none",
 		},
+		ApiConfig: ServerApiConfig{
+			AliveInterval: 30,
+			Retry: RetryConfig{
+				MaxAttempts: 3,
+				BaseBackoff: time.Second,
+				MaxBackoff:  10 * time.Second,
+				Jitter:      0.2,
+			},
+		},
+		MetricsConfig: MetricsConfig{
+			Path: "/metrics",
+		},
+		DataDir:     "/etc/PPanel-node/",
+		GracePeriod: 10,
 	}
 }
 
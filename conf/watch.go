@@ -9,6 +9,21 @@ import (
 )
 
 func (p *Conf) Watch(filePath string, reload func()) error {
+	return Watch(filePath, func() {
+		log.Println("config file changed, reloading...")
+		*p = *New()
+		err := p.LoadFromPath(filePath)
+		if err != nil {
+			log.Printf("reload config error: %s", err)
+		}
+		reload()
+		log.Println("reload config success")
+	})
+}
+
+// Watch calls changed when the file at filePath changes. Changes in quick
+// succession only call it once.
+func Watch(filePath string, changed func()) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("new watcher error: %s", err)
@@ -28,14 +43,7 @@ func (p *Conf) Watch(filePath string, reload func()) error {
 				pre = time.Now()
 				go func() {
 					time.Sleep(5 * time.Second)
-					log.Println("config file changed, reloading...")
-					*p = *New()
-					err := p.LoadFromPath(filePath)
-					if err != nil {
-						log.Printf("reload config error: %s", err)
-					}
-					reload()
-					log.Println("reload config success")
+					changed()
 				}()
 			case err := <-watcher.Errors:
 				if err != nil {
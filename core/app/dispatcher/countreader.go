@@ -1,9 +1,9 @@
 package dispatcher
 
 import (
-	"sync/atomic"
 	"time"
 
+	"github.com/perfect-panel/ppanel-node/common/counter"
 	"github.com/xtls/xray-core/common/buf"
 )
 
@@ -11,7 +11,7 @@ var _ buf.TimeoutReader = (*CounterReader)(nil)
 
 type CounterReader struct {
 	Reader  buf.TimeoutReader
-	Counter *atomic.Int64
+	Counter *counter.XrayTrafficCounter
 }
 
 func (c *CounterReader) ReadMultiBufferTimeout(time.Duration) (buf.MultiBuffer, error) {
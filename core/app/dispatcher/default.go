@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/perfect-panel/ppanel-node/common/counter"
+	"github.com/perfect-panel/ppanel-node/common/metrics"
 	"github.com/perfect-panel/ppanel-node/common/rate"
 	"github.com/perfect-panel/ppanel-node/limiter"
 
@@ -180,12 +181,14 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 			return nil, nil, nil, errors.New("get limiter ", sessionInbound.Tag, " error: ", err)
 		}
 		// Speed Limit and Device Limit
-		w, reject := limit.CheckLimit(user.Email,
-			sessionInbound.Source.Address.IP().String(),
+		ip := sessionInbound.Source.Address.IP().String()
+		up, down, reject := limit.CheckLimit(user.Email,
+			ip,
 			network == net.Network_TCP,
 			sessionInbound.Source.Network == net.Network_TCP)
 		if reject {
 			errors.LogInfo(ctx, "Limited ", user.Email, " by conn or ip")
+			metrics.LinksRejected.WithLabelValues(sessionInbound.Tag, "limit").Inc()
 			common.Close(outboundLink.Writer)
 			common.Close(inboundLink.Writer)
 			common.Interrupt(outboundLink.Reader)
@@ -204,13 +207,27 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 		managedWriter := &ManagedWriter{
 			writer:  uplinkWriter,
 			manager: lm,
+			ip:      ip,
+		}
+		maxLinks, maxIPLinks := limit.ConnLimits(user.Email)
+		if err := lm.TryAddLink(managedWriter, outboundLink.Reader, maxLinks, maxIPLinks); err != nil {
+			errors.LogInfo(ctx, "Limited ", user.Email, " by ", err)
+			metrics.LinksRejected.WithLabelValues(sessionInbound.Tag, rejectReason(err)).Inc()
+			common.Close(outboundLink.Writer)
+			common.Close(inboundLink.Writer)
+			common.Interrupt(outboundLink.Reader)
+			common.Interrupt(inboundLink.Reader)
+			return nil, nil, nil, errors.New("Limited ", user.Email, " by ", err)
 		}
-		lm.AddLink(managedWriter, outboundLink.Reader)
 		inboundLink.Writer = managedWriter
-		if w != nil {
+		if up != nil || down != nil {
 			sessionInbound.CanSpliceCopy = 3
-			inboundLink.Writer = rate.NewRateLimitWriter(inboundLink.Writer, w)
-			outboundLink.Writer = rate.NewRateLimitWriter(outboundLink.Writer, w)
+		}
+		if up != nil {
+			inboundLink.Writer = rate.NewRateLimitWriter(inboundLink.Writer, up)
+		}
+		if down != nil {
+			outboundLink.Writer = rate.NewRateLimitWriter(outboundLink.Writer, down)
 		}
 		var t *counter.TrafficCounter
 		if c, ok := d.Counter.Load(sessionInbound.Tag); !ok {
@@ -220,8 +237,8 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*
 			t = c.(*counter.TrafficCounter)
 		}
 		ts := t.GetCounter(user.Email)
-		upcounter := &counter.XrayTrafficCounter{V: &ts.UpCounter}
-		downcounter := &counter.XrayTrafficCounter{V: &ts.DownCounter}
+		upcounter := t.UpStats(ts)
+		downcounter := t.DownStats(ts)
 		inboundLink.Writer = &dispatcher.SizeStatWriter{
 			Counter: upcounter,
 			Writer:  inboundLink.Writer,
@@ -364,12 +381,14 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 			return errors.New("get limiter ", sessionInbound.Tag, " error: ", err)
 		}
 		// Speed Limit and Device Limit
-		w, reject := limit.CheckLimit(user.Email,
-			sessionInbound.Source.Address.IP().String(),
+		ip := sessionInbound.Source.Address.IP().String()
+		up, down, reject := limit.CheckLimit(user.Email,
+			ip,
 			destination.Network == net.Network_TCP,
 			sessionInbound.Source.Network == net.Network_TCP)
 		if reject {
 			errors.LogInfo(ctx, "Limited ", user.Email, " by conn or ip")
+			metrics.LinksRejected.WithLabelValues(sessionInbound.Tag, "limit").Inc()
 			common.Close(outbound.Writer)
 			common.Interrupt(outbound.Reader)
 			return errors.New("Limited ", user.Email, " by conn or ip")
@@ -386,11 +405,25 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 		managedWriter := &ManagedWriter{
 			writer:  outbound.Writer,
 			manager: lm,
+			ip:      ip,
+		}
+		maxLinks, maxIPLinks := limit.ConnLimits(user.Email)
+		if err := lm.TryAddLink(managedWriter, outbound.Reader, maxLinks, maxIPLinks); err != nil {
+			errors.LogInfo(ctx, "Limited ", user.Email, " by ", err)
+			metrics.LinksRejected.WithLabelValues(sessionInbound.Tag, rejectReason(err)).Inc()
+			common.Close(outbound.Writer)
+			common.Interrupt(outbound.Reader)
+			return errors.New("Limited ", user.Email, " by ", err)
 		}
 		outbound.Writer = managedWriter
-		if w != nil {
+		if up != nil || down != nil {
 			sessionInbound.CanSpliceCopy = 3
-			outbound.Writer = rate.NewRateLimitWriter(outbound.Writer, w)
+		}
+		if up != nil {
+			outbound.Reader = rate.NewRateLimitReader(outbound.Reader, up)
+		}
+		if down != nil {
+			outbound.Writer = rate.NewRateLimitWriter(outbound.Writer, down)
 		}
 		var t *counter.TrafficCounter
 		if c, ok := d.Counter.Load(sessionInbound.Tag); !ok {
@@ -401,10 +434,10 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 		}
 
 		ts := t.GetCounter(user.Email)
-		downcounter := &counter.XrayTrafficCounter{V: &ts.DownCounter}
+		downcounter := t.DownStats(ts)
 		outbound.Reader = &CounterReader{
 			Reader:  &buf.TimeoutWrapperReader{Reader: outbound.Reader},
-			Counter: &ts.UpCounter,
+			Counter: t.UpStats(ts),
 		}
 		outbound.Writer = &dispatcher.SizeStatWriter{
 			Counter: downcounter,
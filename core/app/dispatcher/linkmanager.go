@@ -1,15 +1,30 @@
 package dispatcher
 
 import (
+	"errors"
 	sync "sync"
 
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 )
 
+var (
+	errTooManyLinks   = errors.New("too many connections")
+	errTooManyIPLinks = errors.New("too many connections from the ip")
+)
+
+// rejectReason returns the metric label of a link refused by TryAddLink.
+func rejectReason(err error) string {
+	if err == errTooManyIPLinks {
+		return "ip_conn_limit"
+	}
+	return "conn_limit"
+}
+
 type ManagedWriter struct {
 	writer  buf.Writer
 	manager *LinkManager
+	ip      string
 }
 
 func (w *ManagedWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
@@ -23,24 +38,74 @@ func (w *ManagedWriter) Close() error {
 
 type LinkManager struct {
 	links map[*ManagedWriter]buf.Reader
+	ips   map[string]int // Key: source IP, value: open links
 	mu    sync.Mutex
 }
 
-func (m *LinkManager) AddLink(writer *ManagedWriter, reader buf.Reader) {
+// TryAddLink adds the link unless there are already maxLinks links, or
+// maxIPLinks links from the IP of writer. Zero limits are unlimited.
+func (m *LinkManager) TryAddLink(writer *ManagedWriter, reader buf.Reader, maxLinks, maxIPLinks int) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if maxLinks > 0 && len(m.links) >= maxLinks {
+		return errTooManyLinks
+	}
+	if maxIPLinks > 0 && m.ips[writer.ip] >= maxIPLinks {
+		return errTooManyIPLinks
+	}
+	if m.ips == nil {
+		m.ips = make(map[string]int)
+	}
 	m.links[writer] = reader
+	m.ips[writer.ip]++
+	return nil
 }
 
 func (m *LinkManager) RemoveWriter(writer *ManagedWriter) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, ok := m.links[writer]; !ok {
+		return
+	}
 	delete(m.links, writer)
+	if m.ips[writer.ip]--; m.ips[writer.ip] <= 0 {
+		delete(m.ips, writer.ip)
+	}
+}
+
+func (m *LinkManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.links)
 }
 
 func (m *LinkManager) CloseAll() {
+	m.mu.Lock()
+	links := make(map[*ManagedWriter]buf.Reader, len(m.links))
+	for w, r := range m.links {
+		links[w] = r
+	}
+	m.mu.Unlock()
+	for w, r := range links {
+		common.Close(w)
+		common.Interrupt(r)
+	}
+}
+
+// CloseIPs closes the links from the IPs matched by match and returns how
+// many were closed.
+func (m *LinkManager) CloseIPs(match func(ip string) bool) int {
+	m.mu.Lock()
+	links := make(map[*ManagedWriter]buf.Reader)
 	for w, r := range m.links {
+		if match(w.ip) {
+			links[w] = r
+		}
+	}
+	m.mu.Unlock()
+	for w, r := range links {
 		common.Close(w)
 		common.Interrupt(r)
 	}
+	return len(links)
 }
@@ -0,0 +1,48 @@
+package dispatcher
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/xtls/xray-core/common/buf"
+)
+
+type eofReader struct{}
+
+func (eofReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	return nil, io.EOF
+}
+
+// TestCloseAllWhileLinksChange closes all links, as draining does, while
+// links are added and closed. Run it with -race.
+func TestCloseAllWhileLinksChange(t *testing.T) {
+	m := &LinkManager{
+		links: make(map[*ManagedWriter]buf.Reader),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				w := &ManagedWriter{writer: buf.Discard, manager: m, ip: "127.0.0.1"}
+				if err := m.TryAddLink(w, eofReader{}, 0, 0); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					_ = w.Close()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		m.CloseAll()
+	}
+	wg.Wait()
+	m.CloseAll()
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len() = %d after CloseAll, want 0", n)
+	}
+}
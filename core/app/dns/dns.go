@@ -0,0 +1,76 @@
+// Package dns provides the DNS client of the instance, whose servers can be
+// replaced while it is running.
+package dns
+
+import (
+	"context"
+	"sync/atomic"
+
+	xdns "github.com/xtls/xray-core/app/dns"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/features/dns"
+)
+
+// DNS is the dns.Client of the instance. The router, the dispatcher and the
+// outbounds keep the client they got when they were created, DNS forwards
+// their lookups to the current Xray DNS, which Update replaces.
+type DNS struct {
+	ctx    context.Context
+	server atomic.Pointer[xdns.DNS]
+}
+
+func init() {
+	common.Must(common.RegisterConfig((*Config)(nil), func(ctx context.Context, config interface{}) (interface{}, error) {
+		return New(ctx, config.(*Config))
+	}))
+}
+
+// New creates the DNS client with the servers of config.
+func New(ctx context.Context, config *Config) (*DNS, error) {
+	server, err := xdns.New(ctx, config.GetSettings())
+	if err != nil {
+		return nil, err
+	}
+	d := &DNS{ctx: ctx}
+	d.server.Store(server)
+	return d, nil
+}
+
+// Update replaces the servers with the ones of config. Lookups in flight
+// finish on the old servers.
+func (d *DNS) Update(config *xdns.Config) error {
+	server, err := xdns.New(d.ctx, config)
+	if err != nil {
+		return err
+	}
+	if err := server.Start(); err != nil {
+		return err
+	}
+	return d.server.Swap(server).Close()
+}
+
+// Type implements common.HasType.
+func (*DNS) Type() interface{} {
+	return dns.ClientType()
+}
+
+// Start implements common.Runnable.
+func (d *DNS) Start() error {
+	return d.server.Load().Start()
+}
+
+// Close implements common.Closable.
+func (d *DNS) Close() error {
+	return d.server.Load().Close()
+}
+
+// IsOwnLink implements proxy.dns.ownLinkVerifier.
+func (d *DNS) IsOwnLink(ctx context.Context) bool {
+	return d.server.Load().IsOwnLink(ctx)
+}
+
+// LookupIP implements dns.Client.
+func (d *DNS) LookupIP(domain string, option dns.IPOption) ([]net.IP, uint32, error) {
+	return d.server.Load().LookupIP(domain, option)
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	xdns "github.com/xtls/xray-core/app/dns"
+	"github.com/xtls/xray-core/features/dns"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+)
+
+// hostsConfig returns a DNS config mapping example.com to ip.
+func hostsConfig(t *testing.T, ip string) *xdns.Config {
+	t.Helper()
+	var c coreConf.DNSConfig
+	if err := json.Unmarshal([]byte(`{"hosts":{"example.com":"`+ip+`"}}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	config, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func lookup(t *testing.T, d *DNS) string {
+	t.Helper()
+	ips, _, err := d.LookupIP("example.com", dns.IPOption{IPv4Enable: true})
+	if err != nil {
+		t.Fatalf("LookupIP() error: %v", err)
+	}
+	if len(ips) != 1 {
+		t.Fatalf("LookupIP() = %v, want one IP", ips)
+	}
+	return ips[0].String()
+}
+
+func TestUpdate(t *testing.T) {
+	d, err := New(context.Background(), &Config{Settings: hostsConfig(t, "192.0.2.1")})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer d.Close()
+	if got := lookup(t, d); got != "192.0.2.1" {
+		t.Fatalf("LookupIP() = %s, want 192.0.2.1", got)
+	}
+
+	// The client handed out to the features answers with the new servers
+	if err := d.Update(hostsConfig(t, "192.0.2.2")); err != nil {
+		t.Fatalf("Update() error: %v", err)
+	}
+	if got := lookup(t, d); got != "192.0.2.2" {
+		t.Fatalf("LookupIP() = %s after the update, want 192.0.2.2", got)
+	}
+}
@@ -0,0 +1,126 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v3.21.12
+// source: core/app/dns/ppnode_dns_config.proto
+
+package dns
+
+import (
+	dns "github.com/xtls/xray-core/app/dns"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Config struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Settings      *dns.Config            `protobuf:"bytes,1,opt,name=settings,proto3" json:"settings,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Config) Reset() {
+	*x = Config{}
+	mi := &file_core_app_dns_ppnode_dns_config_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Config) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Config) ProtoMessage() {}
+
+func (x *Config) ProtoReflect() protoreflect.Message {
+	mi := &file_core_app_dns_ppnode_dns_config_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Config.ProtoReflect.Descriptor instead.
+func (*Config) Descriptor() ([]byte, []int) {
+	return file_core_app_dns_ppnode_dns_config_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Config) GetSettings() *dns.Config {
+	if x != nil {
+		return x.Settings
+	}
+	return nil
+}
+
+var File_core_app_dns_ppnode_dns_config_proto protoreflect.FileDescriptor
+
+const file_core_app_dns_ppnode_dns_config_proto_rawDesc = "" +
+	"\n" +
+	"$core/app/dns/ppnode_dns_config.proto\x12\x13ppnode.core.app.dns\x1a\x14app/dns/config.proto\":\n" +
+	"\x06Config\x120\n" +
+	"\bsettings\x18\x01 \x01(\v2\x14.xray.app.dns.ConfigR\bsettingsBi\n" +
+	"\x17com.ppnode.core.app.dnsP\x01Z1github.com/perfect-panel/ppanel-node/core/app/dns\xaa\x02\x18ppanel-node.core.app.dnsb\x06proto3"
+
+var (
+	file_core_app_dns_ppnode_dns_config_proto_rawDescOnce sync.Once
+	file_core_app_dns_ppnode_dns_config_proto_rawDescData []byte
+)
+
+func file_core_app_dns_ppnode_dns_config_proto_rawDescGZIP() []byte {
+	file_core_app_dns_ppnode_dns_config_proto_rawDescOnce.Do(func() {
+		file_core_app_dns_ppnode_dns_config_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_core_app_dns_ppnode_dns_config_proto_rawDesc), len(file_core_app_dns_ppnode_dns_config_proto_rawDesc)))
+	})
+	return file_core_app_dns_ppnode_dns_config_proto_rawDescData
+}
+
+var file_core_app_dns_ppnode_dns_config_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_core_app_dns_ppnode_dns_config_proto_goTypes = []any{
+	(*Config)(nil),     // 0: ppnode.core.app.dns.Config
+	(*dns.Config)(nil), // 1: xray.app.dns.Config
+}
+var file_core_app_dns_ppnode_dns_config_proto_depIdxs = []int32{
+	1, // 0: ppnode.core.app.dns.Config.settings:type_name -> xray.app.dns.Config
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_core_app_dns_ppnode_dns_config_proto_init() }
+func file_core_app_dns_ppnode_dns_config_proto_init() {
+	if File_core_app_dns_ppnode_dns_config_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_core_app_dns_ppnode_dns_config_proto_rawDesc), len(file_core_app_dns_ppnode_dns_config_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_core_app_dns_ppnode_dns_config_proto_goTypes,
+		DependencyIndexes: file_core_app_dns_ppnode_dns_config_proto_depIdxs,
+		MessageInfos:      file_core_app_dns_ppnode_dns_config_proto_msgTypes,
+	}.Build()
+	File_core_app_dns_ppnode_dns_config_proto = out.File
+	file_core_app_dns_ppnode_dns_config_proto_goTypes = nil
+	file_core_app_dns_ppnode_dns_config_proto_depIdxs = nil
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	"github.com/xtls/xray-core/core"
+)
+
+// ConfigError is an error located in the server config. Index is -1 when
+// the error is not caused by one item of Section.
+type ConfigError struct {
+	Section string
+	Index   int
+	Field   string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	location := e.Section
+	if e.Index >= 0 {
+		location = fmt.Sprintf("%s[%d]", location, e.Index)
+	}
+	if e.Field != "" {
+		location += "." + e.Field
+	}
+	return fmt.Sprintf("%s: %s", location, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError is a build error caused by one field of the panel config.
+type fieldError struct {
+	field string
+	err   error
+}
+
+func errField(field string, err error) error {
+	return &fieldError{field: field, err: err}
+}
+
+func (e *fieldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+func newConfigError(section string, index int, err error) *ConfigError {
+	ce := &ConfigError{
+		Section: section,
+		Index:   index,
+		Err:     err,
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		ce.Field = fe.field
+	}
+	return ce
+}
+
+// CheckConfig builds the Xray instance for serverconfig the way the node
+// does without starting it, and returns every error found.
+func CheckConfig(c *conf.Conf, serverconfig *panel.ServerConfigResponse) []*ConfigError {
+	if serverconfig.Data == nil || serverconfig.Data.Protocols == nil {
+		return []*ConfigError{newConfigError("protocols", -1, errors.New("协议配置为空"))}
+	}
+	var errs []*ConfigError
+	if serverconfig.Data.Outbound != nil {
+		for i, item := range *serverconfig.Data.Outbound {
+			outbound, err := buildOutboundDetour(item)
+			if err == nil && outbound == nil {
+				err = errField("protocol", fmt.Errorf("unsupported outbound protocol %q, outbound is ignored", item.Protocol))
+			} else if err == nil {
+				// the node skips outbounds failing here
+				_, err = outbound.Build()
+			}
+			if err != nil {
+				errs = append(errs, newConfigError("outbound", i, err))
+			}
+		}
+	}
+	config, err := buildCoreConfig(c, serverconfig)
+	if err != nil && len(errs) == 0 {
+		errs = append(errs, newConfigError("config", -1, err))
+	}
+	for i := range *serverconfig.Data.Protocols {
+		protocol := &(*serverconfig.Data.Protocols)[i]
+		info := &panel.NodeInfo{
+			Id:       c.ApiConfig.ServerId,
+			Type:     protocol.Type,
+			Protocol: protocol,
+		}
+		inbound, err := buildInbound(info, inboundTag(c, info))
+		if err != nil {
+			errs = append(errs, newConfigError("protocols", i, err))
+			continue
+		}
+		if config != nil && protocol.Enable {
+			config.Inbound = append(config.Inbound, inbound)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	// Creating the instance validates the features, nothing is started
+	server, err := core.New(config)
+	if err != nil {
+		return []*ConfigError{newConfigError("config", -1, err)}
+	}
+	_ = server.Close()
+	return nil
+}
+
+// inboundTag returns the tag the node gives to the inbound of info.
+func inboundTag(c *conf.Conf, info *panel.NodeInfo) string {
+	return fmt.Sprintf("[%s]-%s:%d", c.ApiConfig.ApiHost, info.Type, info.Id)
+}
+
+// ValidateConfig builds the Xray config and the enabled inbounds of
+// serverconfig as Start and the nodes do, and returns the first error as
+// *ConfigError. Unlike CheckConfig no instance is created, creating one
+// would take over the log handler of the running instance.
+func ValidateConfig(c *conf.Conf, serverconfig *panel.ServerConfigResponse) error {
+	if serverconfig.Data == nil || serverconfig.Data.Protocols == nil {
+		return newConfigError("protocols", -1, errors.New("协议配置为空"))
+	}
+	if _, err := buildCoreConfig(c, serverconfig); err != nil {
+		return newConfigError("config", -1, err)
+	}
+	for i := range *serverconfig.Data.Protocols {
+		protocol := &(*serverconfig.Data.Protocols)[i]
+		if !protocol.Enable {
+			continue
+		}
+		info := &panel.NodeInfo{
+			Id:       c.ApiConfig.ServerId,
+			Type:     protocol.Type,
+			Protocol: protocol,
+		}
+		if _, err := buildInbound(info, inboundTag(c, info)); err != nil {
+			return newConfigError("protocols", i, err)
+		}
+	}
+	return nil
+}
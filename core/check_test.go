@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+func TestCheckConfigLocatesErrors(t *testing.T) {
+	outbound := []panel.Outbound{
+		{
+			Name:           "proxy",
+			Protocol:       "vless",
+			Address:        "1.1.1.1",
+			Port:           443,
+			UUID:           "b831381d-6324-4d53-ad4f-8cda48b30811",
+			StreamSettings: "{bad",
+		},
+	}
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: 10001, Transport: "tcp", Enable: true},
+		{Type: "vmess", Port: 10002, Transport: "quic", Enable: true},
+	}
+
+	errs := CheckConfig(conf.New(), &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Outbound:   &outbound,
+			Protocols:  &protocols,
+		},
+	})
+	want := []ConfigError{
+		{Section: "outbound", Index: 0, Field: "stream_settings"},
+		{Section: "protocols", Index: 1, Field: "transport"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("CheckConfig() = %v, want %d errors", errs, len(want))
+	}
+	for i := range want {
+		if errs[i].Section != want[i].Section || errs[i].Index != want[i].Index || errs[i].Field != want[i].Field {
+			t.Fatalf("CheckConfig()[%d] = %v, want %s[%d].%s", i, errs[i], want[i].Section, want[i].Index, want[i].Field)
+		}
+	}
+}
+
+func TestCheckConfigBuildsInstance(t *testing.T) {
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: 10001, Transport: "tcp", Enable: true},
+		{Type: "shadowsocks", Port: 10002, Cipher: "aes-128-gcm", Enable: true},
+	}
+
+	errs := CheckConfig(conf.New(), &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Protocols:  &protocols,
+		},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("CheckConfig() = %v, want no errors", errs)
+	}
+}
+
+func TestValidateConfigSkipsDisabled(t *testing.T) {
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: 10001, Transport: "tcp", Enable: true},
+		{Type: "vmess", Port: 10002, Transport: "quic", Enable: false},
+		{Type: "trojan", Port: 10003, Transport: "quic", Enable: true},
+	}
+
+	err := ValidateConfig(conf.New(), &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Protocols:  &protocols,
+		},
+	})
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("ValidateConfig() = %v, want *ConfigError", err)
+	}
+	if ce.Section != "protocols" || ce.Index != 2 || ce.Field != "transport" {
+		t.Fatalf("ValidateConfig() = %v, want protocols[2].transport", ce)
+	}
+}
+
+func TestStartReturnsConfigError(t *testing.T) {
+	outbound := []panel.Outbound{
+		{
+			Name:           "proxy",
+			Protocol:       "vless",
+			Address:        "1.1.1.1",
+			Port:           443,
+			UUID:           "b831381d-6324-4d53-ad4f-8cda48b30811",
+			StreamSettings: "{bad",
+		},
+	}
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: 10001, Transport: "tcp", Enable: true},
+	}
+
+	xcore := New(conf.New(), nil)
+	err := xcore.Start(&panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Outbound:   &outbound,
+			Protocols:  &protocols,
+		},
+	})
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Start() = %v, want *ConfigError", err)
+	}
+	if errors.Is(err, ErrInstance) {
+		t.Fatalf("Start() = %v, a config error must not wrap ErrInstance", err)
+	}
+}
@@ -34,7 +34,7 @@ func hasPublicIPv6() bool {
 	return false
 }
 
-func hasOutboundWithTag(list []*core.OutboundHandlerConfig, tag string) bool {
+func hasOutboundWithTag(list []*coreConf.OutboundDetourConfig, tag string) bool {
 	for _, o := range list {
 		if o != nil && o.Tag == tag {
 			return true
@@ -110,7 +110,7 @@ func rawJSONMessage(value string, field string) (*json.RawMessage, error) {
 		return nil, nil
 	}
 	if !json.Valid([]byte(value)) {
-		return nil, fmt.Errorf("invalid outbound %s json", field)
+		return nil, errField(field, fmt.Errorf("invalid outbound %s json", field))
 	}
 	raw := json.RawMessage(value)
 	return &raw, nil
@@ -202,7 +202,7 @@ func buildOutboundStreamConfig(item panel.Outbound) (*coreConf.StreamConfig, err
 	if raw := strings.TrimSpace(item.StreamSettings); raw != "" {
 		var stream coreConf.StreamConfig
 		if err := json.Unmarshal([]byte(raw), &stream); err != nil {
-			return nil, fmt.Errorf("invalid outbound stream_settings json: %w", err)
+			return nil, errField("stream_settings", fmt.Errorf("invalid outbound stream_settings json: %w", err))
 		}
 		return &stream, nil
 	}
@@ -255,7 +255,7 @@ func buildOutboundStreamConfig(item panel.Outbound) (*coreConf.StreamConfig, err
 			SpiderX:     firstNonEmpty(item.SpiderX, "/"),
 		}
 	default:
-		return nil, fmt.Errorf("unsupported outbound security %q", item.Security)
+		return nil, errField("security", fmt.Errorf("unsupported outbound security %q", item.Security))
 	}
 
 	switch transport {
@@ -285,13 +285,62 @@ func buildOutboundStreamConfig(item panel.Outbound) (*coreConf.StreamConfig, err
 		}
 	case "tuic", "hysteria":
 	default:
-		return nil, fmt.Errorf("unsupported outbound transport %q", item.Transport)
+		return nil, errField("transport", fmt.Errorf("unsupported outbound transport %q", item.Transport))
 	}
 
 	return stream, nil
 }
 
+// buildOutboundDetour builds the Xray config of a panel outbound, nil when
+// the protocol is not supported.
+func buildOutboundDetour(item panel.Outbound) (*coreConf.OutboundDetourConfig, error) {
+	protocol, rawSettings, err := buildOutboundSettings(item)
+	if err != nil {
+		return nil, err
+	}
+	if protocol == "" || rawSettings == nil {
+		return nil, nil
+	}
+	streamSettings, err := buildOutboundStreamConfig(item)
+	if err != nil {
+		return nil, err
+	}
+	return &coreConf.OutboundDetourConfig{
+		Tag:           item.Name,
+		Protocol:      protocol,
+		Settings:      rawSettings,
+		StreamSetting: streamSettings,
+	}, nil
+}
+
 func GetCustomConfig(serverconfig *panel.ServerConfigResponse) (*dns.Config, []*core.OutboundHandlerConfig, *router.Config, error) {
+	coreDnsConfig, outbounds, coreRouterConfig, err := buildCustomConfig(serverconfig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//build config
+	coreOutboundConfig := make([]*core.OutboundHandlerConfig, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		o, err := outbound.Build()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		coreOutboundConfig = append(coreOutboundConfig, o)
+	}
+	DnsConfig, err := coreDnsConfig.Build()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	RouterConfig, err := coreRouterConfig.Build()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return DnsConfig, coreOutboundConfig, RouterConfig, nil
+}
+
+// buildCustomConfig builds the DNS, outbound and routing config from the
+// panel settings, before they are converted to the Xray runtime config.
+func buildCustomConfig(serverconfig *panel.ServerConfigResponse) (*coreConf.DNSConfig, []*coreConf.OutboundDetourConfig, *coreConf.RouterConfig, error) {
 	var ip_strategy string
 	if serverconfig.Data.IPStrategy != "" {
 		switch serverconfig.Data.IPStrategy {
@@ -375,7 +424,7 @@ func GetCustomConfig(serverconfig *panel.ServerConfigResponse) (*dns.Config, []*
 
 	//default outbound
 	defaultoutbound, _ := buildDefaultOutbound()
-	coreOutboundConfig := append([]*core.OutboundHandlerConfig{}, defaultoutbound)
+	coreOutboundConfig := append([]*coreConf.OutboundDetourConfig{}, defaultoutbound)
 	block, _ := buildBlockOutbound()
 	coreOutboundConfig = append(coreOutboundConfig, block)
 	dns, _ := buildDnsOutbound()
@@ -411,53 +460,33 @@ func GetCustomConfig(serverconfig *panel.ServerConfigResponse) (*dns.Config, []*
 	//custom outbound
 	if outboundList != nil {
 		for _, outbounditem := range *outboundList {
-			protocol, rawSettings, err := buildOutboundSettings(outbounditem)
+			outbound, err := buildOutboundDetour(outbounditem)
 			if err != nil {
 				return nil, nil, nil, err
 			}
-			if protocol == "" || rawSettings == nil {
+			if outbound == nil {
 				continue
 			}
-			streamSettings, err := buildOutboundStreamConfig(outbounditem)
-			if err != nil {
-				return nil, nil, nil, err
-			}
-			outbound := &coreConf.OutboundDetourConfig{
-				Tag:           outbounditem.Name,
-				Protocol:      protocol,
-				Settings:      rawSettings,
-				StreamSetting: streamSettings,
-			}
 			// Outbound rules
 			domains := buildRouteDomains(outbounditem.Rules)
-			custom_outbound, err := outbound.Build()
-			if err != nil {
+			if _, err := outbound.Build(); err != nil {
 				continue
 			}
 			if len(domains) > 0 {
 				rule := map[string]interface{}{
 					"domain":      domains,
-					"outboundTag": custom_outbound.Tag,
+					"outboundTag": outbound.Tag,
 				}
 				rawRule, err := json.Marshal(rule)
 				if err == nil {
 					coreRouterConfig.RuleList = append(coreRouterConfig.RuleList, rawRule)
 				}
 			}
-			if hasOutboundWithTag(coreOutboundConfig, custom_outbound.Tag) {
+			if hasOutboundWithTag(coreOutboundConfig, outbound.Tag) {
 				continue
 			}
-			coreOutboundConfig = append(coreOutboundConfig, custom_outbound)
+			coreOutboundConfig = append(coreOutboundConfig, outbound)
 		}
 	}
-	//build config
-	DnsConfig, err := coreDnsConfig.Build()
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	RouterConfig, err := coreRouterConfig.Build()
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	return DnsConfig, coreOutboundConfig, RouterConfig, nil
+	return coreDnsConfig, coreOutboundConfig, coreRouterConfig, nil
 }
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+)
+
+// BuildXrayConfig returns the Xray JSON config equivalent to what the node
+// runs for serverconfig, so it can be loaded by a plain Xray binary. Users
+// are added at runtime and are not part of the inbounds.
+func BuildXrayConfig(c *conf.Conf, serverconfig *panel.ServerConfigResponse) (*coreConf.Config, error) {
+	if serverconfig.Data == nil || serverconfig.Data.Protocols == nil {
+		return nil, errors.New("协议配置为空")
+	}
+	dnsConfig, outbounds, routerConfig, err := buildCustomConfig(serverconfig)
+	if err != nil {
+		return nil, fmt.Errorf("build custom config error: %w", err)
+	}
+	config := &coreConf.Config{
+		LogConfig:    buildLogConfig(c),
+		RouterConfig: routerConfig,
+		DNSConfig:    dnsConfig,
+		Policy:       buildPolicyConfig(),
+		Stats:        &coreConf.StatsConfig{},
+	}
+	for _, outbound := range outbounds {
+		config.OutboundConfigs = append(config.OutboundConfigs, *outbound)
+	}
+	for i := range *serverconfig.Data.Protocols {
+		protocol := &(*serverconfig.Data.Protocols)[i]
+		if !protocol.Enable {
+			continue
+		}
+		info := &panel.NodeInfo{
+			Id:       c.ApiConfig.ServerId,
+			Type:     protocol.Type,
+			Protocol: protocol,
+		}
+		inbound, err := buildInboundDetour(info, inboundTag(c, info))
+		if err != nil {
+			return nil, fmt.Errorf("build inbound %s error: %w", info.Type, err)
+		}
+		config.InboundConfigs = append(config.InboundConfigs, *inbound)
+	}
+	return config, nil
+}
+
+// MarshalXrayConfig encodes config as indented JSON. Null values are left
+// out: Xray reads a null raw message, like a TCP header, as a set value.
+func MarshalXrayConfig(config *coreConf.Config) ([]byte, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(dropNulls(v), "", "  ")
+}
+
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = dropNulls(value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = dropNulls(v[i])
+		}
+	}
+	return v
+}
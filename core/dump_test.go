@@ -0,0 +1,65 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+)
+
+func TestBuildXrayConfigLoadsInXray(t *testing.T) {
+	dns := []panel.DNSItem{{Address: "8.8.8.8", Domains: []string{"suffix:google.com"}}}
+	block := []string{"suffix:ads.example"}
+	outbound := []panel.Outbound{
+		{
+			Name:      "proxy",
+			Protocol:  "vless",
+			Address:   "1.1.1.1",
+			Port:      443,
+			UUID:      "b831381d-6324-4d53-ad4f-8cda48b30811",
+			Transport: "ws",
+			Path:      "/ws",
+			Security:  "tls",
+			SNI:       "example.com",
+			Rules:     []string{"suffix:example.org"},
+		},
+	}
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: 10001, Transport: "tcp", Enable: true},
+		{Type: "shadowsocks", Port: 10002, Cipher: "aes-128-gcm", Enable: true},
+		{Type: "trojan", Port: 10003, Transport: "grpc", Enable: false},
+	}
+
+	config, err := BuildXrayConfig(conf.New(), &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			DNS:        &dns,
+			Block:      &block,
+			Outbound:   &outbound,
+			Protocols:  &protocols,
+		},
+	})
+	if err != nil {
+		t.Fatalf("BuildXrayConfig() error = %v", err)
+	}
+	data, err := MarshalXrayConfig(config)
+	if err != nil {
+		t.Fatalf("marshal config error = %v", err)
+	}
+	loaded := &coreConf.Config{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("unmarshal config error = %v", err)
+	}
+	built, err := loaded.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if got := len(built.Inbound); got != 2 {
+		t.Fatalf("inbounds len = %d, want 2 enabled inbounds", got)
+	}
+	if got := len(built.Outbound); got != 4 {
+		t.Fatalf("outbounds len = %d, want 3 default and 1 custom", got)
+	}
+}
@@ -45,6 +45,15 @@ func (v *XrayCore) addInbound(config *core.InboundHandlerConfig) error {
 
 // BuildInbound build Inbound config for different protocol
 func buildInbound(nodeInfo *panel.NodeInfo, tag string) (*core.InboundHandlerConfig, error) {
+	in, err := buildInboundDetour(nodeInfo, tag)
+	if err != nil {
+		return nil, err
+	}
+	return in.Build()
+}
+
+// buildInboundDetour builds the Xray JSON config of the inbound.
+func buildInboundDetour(nodeInfo *panel.NodeInfo, tag string) (*coreConf.InboundDetourConfig, error) {
 	in := &coreConf.InboundDetourConfig{}
 	var err error
 	switch nodeInfo.Type {
@@ -63,7 +72,7 @@ func buildInbound(nodeInfo *panel.NodeInfo, tag string) (*core.InboundHandlerCon
 	case "anytls":
 		err = buildAnyTLS(nodeInfo, in)
 	default:
-		return nil, fmt.Errorf("unsupported node type: %s", nodeInfo.Type)
+		return nil, errField("type", fmt.Errorf("unsupported node type: %s", nodeInfo.Type))
 	}
 	if err != nil {
 		return nil, err
@@ -137,7 +146,7 @@ func buildInbound(nodeInfo *panel.NodeInfo, tag string) (*core.InboundHandlerCon
 		break
 	}
 	in.Tag = tag
-	return in.Build()
+	return in, nil
 }
 
 func buildVLess(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourConfig) error {
@@ -158,7 +167,7 @@ func buildVLess(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourConfig)
 			parts = append(parts, nodeInfo.Protocol.EncryptionPrivateKey)
 			decryption = strings.Join(parts, ".")
 		default:
-			return fmt.Errorf("vless decryption method %s is not support", nodeInfo.Protocol.Encryption)
+			return errField("encryption", fmt.Errorf("vless decryption method %s is not support", nodeInfo.Protocol.Encryption))
 		}
 	}
 	s, err := json.Marshal(&coreConf.VLessInboundConfig{
@@ -198,7 +207,7 @@ func buildVLess(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourConfig)
 			//Extra: json.RawMessage(nodeInfo.Protocol.XHTTPExtra),
 		}
 	default:
-		return errors.New("the network type is not vail")
+		return errField("transport", errors.New("the network type is not vail"))
 	}
 	return nil
 }
@@ -241,7 +250,7 @@ func buildVMess(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourConfig)
 			//Extra: json.RawMessage(nodeInfo.Protocol.XHTTPExtra),
 		}
 	default:
-		return errors.New("the network type is not vail")
+		return errField("transport", errors.New("the network type is not vail"))
 	}
 	return nil
 }
@@ -269,7 +278,7 @@ func buildTrojan(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourConfig
 			ServiceName: nodeInfo.Protocol.ServiceName,
 		}
 	default:
-		return errors.New("the network type is not vail")
+		return errField("transport", errors.New("the network type is not vail"))
 	}
 	return nil
 }
@@ -288,8 +297,7 @@ func buildShadowsocks(nodeInfo *panel.NodeInfo, inbound *coreConf.InboundDetourC
 	randomPasswd := hex.EncodeToString(p)
 
 	if nodeInfo.Protocol.ServerKey != "" && strings.Contains(cipher, "2022") {
-		nodeInfo.Protocol.ServerKey = base64.StdEncoding.EncodeToString([]byte(nodeInfo.Protocol.ServerKey))
-		settings.Password = nodeInfo.Protocol.ServerKey
+		settings.Password = base64.StdEncoding.EncodeToString([]byte(nodeInfo.Protocol.ServerKey))
 		randomPasswd = base64.StdEncoding.EncodeToString([]byte(randomPasswd))
 		cipher = ""
 	}
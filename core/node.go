@@ -2,8 +2,11 @@ package core
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/core/app/dispatcher"
 )
 
 func (v *XrayCore) AddNode(tag string, info *panel.NodeInfo) error {
@@ -25,3 +28,68 @@ func (v *XrayCore) DelNode(tag string) error {
 	}
 	return nil
 }
+
+// ActiveLinks returns the number of open user links on the inbound tag.
+func (v *XrayCore) ActiveLinks(tag string) int {
+	links := 0
+	prefix := format.UserTag(tag, "")
+	v.dispatcher.LinkManagers.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			links += value.(*dispatcher.LinkManager).Len()
+		}
+		return true
+	})
+	return links
+}
+
+// UserLinks returns the number of open links per user ID on the inbound tag.
+func (v *XrayCore) UserLinks(tag string) map[int]int {
+	links := make(map[int]int)
+	prefix := format.UserTag(tag, "")
+	v.users.mapLock.RLock()
+	defer v.users.mapLock.RUnlock()
+	v.dispatcher.LinkManagers.Range(func(key, value interface{}) bool {
+		if !strings.HasPrefix(key.(string), prefix) {
+			return true
+		}
+		if uid := v.users.uidMap[key.(string)]; uid != 0 {
+			links[uid] += value.(*dispatcher.LinkManager).Len()
+		}
+		return true
+	})
+	return links
+}
+
+// CloseLinks closes all user links on the inbound tag.
+func (v *XrayCore) CloseLinks(tag string) {
+	prefix := format.UserTag(tag, "")
+	v.dispatcher.LinkManagers.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			value.(*dispatcher.LinkManager).CloseAll()
+		}
+		return true
+	})
+}
+
+// CloseUserLinks closes the links of the user taguuid and returns how many
+// were open.
+func (v *XrayCore) CloseUserLinks(taguuid string) int {
+	value, ok := v.dispatcher.LinkManagers.Load(taguuid)
+	if !ok {
+		return 0
+	}
+	lm := value.(*dispatcher.LinkManager)
+	links := lm.Len()
+	lm.CloseAll()
+	return links
+}
+
+// CloseDeviceLinks closes the links of the user taguuid from the IPs matched
+// by match and returns how many were open.
+func (v *XrayCore) CloseDeviceLinks(taguuid string, match func(ip string) bool) int {
+	value, ok := v.dispatcher.LinkManagers.Load(taguuid)
+	if !ok {
+		return 0
+	}
+	return value.(*dispatcher.LinkManager).CloseIPs(match)
+}
@@ -1,15 +1,42 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/protobuf/proto"
 )
 
+func (v *XrayCore) removeOutbound(tag string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return v.ohm.RemoveHandler(ctx, tag)
+}
+
+func (v *XrayCore) addOutbound(config *core.OutboundHandlerConfig) error {
+	rawHandler, err := core.CreateObject(v.Server, config)
+	if err != nil {
+		return err
+	}
+	handler, ok := rawHandler.(outbound.Handler)
+	if !ok {
+		return fmt.Errorf("not an OutboundHandler: %s", config.Tag)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := v.ohm.AddHandler(ctx, handler); err != nil {
+		return err
+	}
+	return nil
+}
+
 // build default freedom outbund
-func buildDefaultOutbound() (*core.OutboundHandlerConfig, error) {
+func buildDefaultOutbound() (*conf.OutboundDetourConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	outboundDetourConfig.Protocol = "freedom"
 	outboundDetourConfig.Tag = "Default"
@@ -25,21 +52,44 @@ func buildDefaultOutbound() (*core.OutboundHandlerConfig, error) {
 		return nil, fmt.Errorf("marshal proxy config error: %s", err)
 	}
 	outboundDetourConfig.Settings = &setting
-	return outboundDetourConfig.Build()
+	return outboundDetourConfig, nil
 }
 
 // build block outbund
-func buildBlockOutbound() (*core.OutboundHandlerConfig, error) {
+func buildBlockOutbound() (*conf.OutboundDetourConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	outboundDetourConfig.Protocol = "blackhole"
 	outboundDetourConfig.Tag = "block"
-	return outboundDetourConfig.Build()
+	return outboundDetourConfig, nil
 }
 
 // build dns outbound
-func buildDnsOutbound() (*core.OutboundHandlerConfig, error) {
+func buildDnsOutbound() (*conf.OutboundDetourConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	outboundDetourConfig.Protocol = "dns"
 	outboundDetourConfig.Tag = "dns_out"
-	return outboundDetourConfig.Build()
+	return outboundDetourConfig, nil
+}
+
+// diffOutbounds compares two outbound lists by tag.
+func diffOutbounds(old, new []*core.OutboundHandlerConfig) (added, changed []*core.OutboundHandlerConfig, removed []string) {
+	oldMap := make(map[string]*core.OutboundHandlerConfig, len(old))
+	for _, o := range old {
+		oldMap[o.Tag] = o
+	}
+	for _, o := range new {
+		prev, ok := oldMap[o.Tag]
+		if !ok {
+			added = append(added, o)
+			continue
+		}
+		delete(oldMap, o.Tag)
+		if !proto.Equal(prev, o) {
+			changed = append(changed, o)
+		}
+	}
+	for tag := range oldMap {
+		removed = append(removed, tag)
+	}
+	return added, changed, removed
 }
@@ -42,12 +42,16 @@ func (v *XrayCore) GetUserManager(tag string) (proxy.UserManager, error) {
 	return userManager, nil
 }
 
-func (vc *XrayCore) DelUsers(users []panel.UserInfo, tag string, _ *panel.NodeInfo) error {
+// DelUsers removes users from the inbound tag and closes their links. It
+// returns the traffic counted for them since the last report, which would
+// be lost with their counters.
+func (vc *XrayCore) DelUsers(users []panel.UserInfo, tag string, _ *panel.NodeInfo) ([]panel.UserTraffic, error) {
 	userManager, err := vc.GetUserManager(tag)
 	if err != nil {
-		return fmt.Errorf("get user manager error: %s", err)
+		return nil, fmt.Errorf("get user manager error: %s", err)
 	}
 	var user string
+	var traffic []panel.UserTraffic
 	vc.users.mapLock.Lock()
 	defer vc.users.mapLock.Unlock()
 	for i := range users {
@@ -56,20 +60,31 @@ func (vc *XrayCore) DelUsers(users []panel.UserInfo, tag string, _ *panel.NodeIn
 		err = userManager.RemoveUser(ctx, user)
 		cancel()
 		if err != nil {
-			return err
+			return traffic, err
 		}
 		delete(vc.users.uidMap, user)
-		if v, ok := vc.dispatcher.Counter.Load(tag); ok {
-			tc := v.(*counter.TrafficCounter)
-			tc.Delete(user)
-		}
 		if v, ok := vc.dispatcher.LinkManagers.Load(user); ok {
 			lm := v.(*dispatcher.LinkManager)
 			lm.CloseAll()
 			vc.dispatcher.LinkManagers.Delete(user)
 		}
+		if v, ok := vc.dispatcher.Counter.Load(tag); ok {
+			tc := v.(*counter.TrafficCounter)
+			if c, ok := tc.Counters.Load(user); ok {
+				ts := c.(*counter.TrafficStorage)
+				up, down := ts.UpCounter.Swap(0), ts.DownCounter.Swap(0)
+				if up+down > 0 {
+					traffic = append(traffic, panel.UserTraffic{
+						UID:      users[i].Id,
+						Upload:   up,
+						Download: down,
+					})
+				}
+			}
+			tc.Delete(user)
+		}
 	}
-	return nil
+	return traffic, nil
 }
 
 func (vc *XrayCore) GetUserTrafficSlice(tag string, mintraffic int) ([]panel.UserTraffic, error) {
@@ -106,6 +121,64 @@ func (vc *XrayCore) GetUserTrafficSlice(tag string, mintraffic int) ([]panel.Use
 	return nil, nil
 }
 
+// PeekUserTraffic returns the traffic counted for tag without resetting the counters.
+func (vc *XrayCore) PeekUserTraffic(tag string) []panel.UserTraffic {
+	var trafficSlice []panel.UserTraffic
+	vc.users.mapLock.RLock()
+	defer vc.users.mapLock.RUnlock()
+	if v, ok := vc.dispatcher.Counter.Load(tag); ok {
+		c := v.(*counter.TrafficCounter)
+		c.Counters.Range(func(key, value interface{}) bool {
+			traffic := value.(*counter.TrafficStorage)
+			up := traffic.UpCounter.Load()
+			down := traffic.DownCounter.Load()
+			uid := vc.users.uidMap[key.(string)]
+			if uid != 0 && up+down > 0 {
+				trafficSlice = append(trafficSlice, panel.UserTraffic{
+					UID:      uid,
+					Upload:   up,
+					Download: down,
+				})
+			}
+			return true
+		})
+	}
+	return trafficSlice
+}
+
+// TrafficTotals returns the bytes counted on tag since the core started,
+// for the whole inbound and per user.
+func (vc *XrayCore) TrafficTotals(tag string) (up, down int64, users []panel.UserTraffic) {
+	vc.users.mapLock.RLock()
+	defer vc.users.mapLock.RUnlock()
+	v, ok := vc.dispatcher.Counter.Load(tag)
+	if !ok {
+		return 0, 0, nil
+	}
+	c := v.(*counter.TrafficCounter)
+	c.Counters.Range(func(key, value interface{}) bool {
+		traffic := value.(*counter.TrafficStorage)
+		if uid := vc.users.uidMap[key.(string)]; uid != 0 {
+			users = append(users, panel.UserTraffic{
+				UID:      uid,
+				Upload:   traffic.UpTotal.Load(),
+				Download: traffic.DownTotal.Load(),
+			})
+		}
+		return true
+	})
+	return c.UpTotal.Load(), c.DownTotal.Load(), users
+}
+
+// TrafficCounter returns the traffic counter of the inbound tag, nil before
+// its first connection.
+func (vc *XrayCore) TrafficCounter(tag string) *counter.TrafficCounter {
+	if v, ok := vc.dispatcher.Counter.Load(tag); ok {
+		return v.(*counter.TrafficCounter)
+	}
+	return nil
+}
+
 func (v *XrayCore) AddUsers(p *AddUsersParams) (added int, err error) {
 	v.users.mapLock.Lock()
 	defer v.users.mapLock.Unlock()
@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -9,12 +11,14 @@ import (
 	"github.com/perfect-panel/ppanel-node/common/task"
 	"github.com/perfect-panel/ppanel-node/conf"
 	"github.com/perfect-panel/ppanel-node/core/app/dispatcher"
+	"github.com/perfect-panel/ppanel-node/core/app/dns"
 	_ "github.com/perfect-panel/ppanel-node/core/distro/all"
 	log "github.com/sirupsen/logrus"
 	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/app/stats"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/core"
+	xdns "github.com/xtls/xray-core/features/dns"
 	"github.com/xtls/xray-core/features/inbound"
 	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/features/routing"
@@ -28,10 +32,17 @@ type AddUsersParams struct {
 	*panel.NodeInfo
 }
 
+// ErrInstance is wrapped by the errors of Start when the Xray instance fails
+// to be created or started although the server config is valid, a port in
+// use for example. Errors of the server config are *ConfigError.
+var ErrInstance = errors.New("xray instance error")
+
 type XrayCore struct {
 	Config                      *conf.Conf
-	Client                      *panel.ClientV2
+	Provider                    panel.Provider
 	ReloadCh                    chan struct{}
+	UpdateCh                    chan *panel.ServerConfigResponse
+	serverConfig                *panel.ServerConfigResponse
 	serverConfigMonitorPeriodic *task.Task
 	access                      sync.Mutex
 	Server                      *core.Instance
@@ -39,6 +50,7 @@ type XrayCore struct {
 	ihm                         inbound.Manager
 	ohm                         outbound.Manager
 	dispatcher                  *dispatcher.DefaultDispatcher
+	dns                         *dns.DNS
 }
 
 type UserMap struct {
@@ -46,10 +58,10 @@ type UserMap struct {
 	mapLock sync.RWMutex
 }
 
-func New(config *conf.Conf, client *panel.ClientV2) *XrayCore {
+func New(config *conf.Conf, provider panel.Provider) *XrayCore {
 	core := &XrayCore{
-		Config: config,
-		Client: client,
+		Config:   config,
+		Provider: provider,
 		users: &UserMap{
 			uidMap: make(map[string]int),
 		},
@@ -60,17 +72,91 @@ func New(config *conf.Conf, client *panel.ClientV2) *XrayCore {
 func (v *XrayCore) Start(serverconfig *panel.ServerConfigResponse) error {
 	v.access.Lock()
 	defer v.access.Unlock()
-	v.Server = getCore(v.Config, serverconfig)
-	if err := v.Server.Start(); err != nil {
+	server, err := getCore(v.Config, serverconfig)
+	if err != nil {
 		return err
 	}
+	if err := server.Start(); err != nil {
+		_ = server.Close()
+		return fmt.Errorf("%w: start instance: %w", ErrInstance, err)
+	}
+	v.Server = server
 	v.ihm = v.Server.GetFeature(inbound.ManagerType()).(inbound.Manager)
 	v.ohm = v.Server.GetFeature(outbound.ManagerType()).(outbound.Manager)
 	v.dispatcher = v.Server.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	v.dns = v.Server.GetFeature(xdns.ClientType()).(*dns.DNS)
+	v.serverConfig = serverconfig
 	v.startTasks(serverconfig)
 	return nil
 }
 
+// ServerConfig returns the server config the instance is running with.
+func (v *XrayCore) ServerConfig() *panel.ServerConfigResponse {
+	v.access.Lock()
+	defer v.access.Unlock()
+	return v.serverConfig
+}
+
+// Update applies the DNS, outbound and routing changes of serverconfig to
+// the running instance through the Xray feature managers, so the inbounds
+// and their connections are not touched. The IP strategy is part of the DNS
+// config, a change replaces the DNS servers.
+func (v *XrayCore) Update(serverconfig *panel.ServerConfigResponse) error {
+	v.access.Lock()
+	defer v.access.Unlock()
+	old := v.serverConfig.Data
+	data := serverconfig.Data
+	oldDNS, oldOutbounds, oldRoute, err := GetCustomConfig(v.serverConfig)
+	if err != nil {
+		return fmt.Errorf("build running custom config error: %w", err)
+	}
+	newDNS, newOutbounds, newRoute, err := GetCustomConfig(serverconfig)
+	if err != nil {
+		return fmt.Errorf("build custom config error: %w", err)
+	}
+	if !proto.Equal(oldDNS, newDNS) {
+		if err := v.dns.Update(newDNS); err != nil {
+			return fmt.Errorf("replace dns servers error: %w", err)
+		}
+		log.Info("DNS 已更新")
+	}
+	added, changed, removed := diffOutbounds(oldOutbounds, newOutbounds)
+	for _, o := range added {
+		if err := v.addOutbound(o); err != nil {
+			return fmt.Errorf("add outbound %s error: %w", o.Tag, err)
+		}
+	}
+	for _, o := range changed {
+		if err := v.removeOutbound(o.Tag); err != nil {
+			return fmt.Errorf("remove outbound %s error: %w", o.Tag, err)
+		}
+		if err := v.addOutbound(o); err != nil {
+			return fmt.Errorf("add outbound %s error: %w", o.Tag, err)
+		}
+	}
+	if !proto.Equal(oldRoute, newRoute) {
+		router := v.Server.GetFeature(routing.RouterType()).(routing.Router)
+		if err := router.AddRule(serial.ToTypedMessage(newRoute), false); err != nil {
+			return fmt.Errorf("replace routing rules error: %w", err)
+		}
+	}
+	// Remove outbounds only after no rule refers to them anymore
+	for _, tag := range removed {
+		if err := v.removeOutbound(tag); err != nil {
+			return fmt.Errorf("remove outbound %s error: %w", tag, err)
+		}
+	}
+	v.serverConfig = serverconfig
+	if old.PullInterval != data.PullInterval {
+		v.serverConfigMonitorPeriodic.Close()
+		v.startTasks(serverconfig)
+	}
+	if len(added)+len(changed)+len(removed) > 0 {
+		log.Infof("出站已更新: 新增 %d 个, 变更 %d 个, 删除 %d 个", len(added), len(changed), len(removed))
+	}
+	return nil
+}
+
 func (v *XrayCore) Close() error {
 	v.access.Lock()
 	defer v.access.Unlock()
@@ -81,6 +167,11 @@ func (v *XrayCore) Close() error {
 	v.ihm = nil
 	v.ohm = nil
 	v.dispatcher = nil
+	v.dns = nil
+	if v.Server == nil {
+		// never started
+		return nil
+	}
 	err := v.Server.Close()
 	if err != nil {
 		return err
@@ -88,34 +179,35 @@ func (v *XrayCore) Close() error {
 	return nil
 }
 
-func getCore(c *conf.Conf, serverconfig *panel.ServerConfigResponse) *core.Instance {
-	// Log Config
-	coreLogConfig := &coreConf.LogConfig{
-		LogLevel:  c.LogConfig.Level,
-		AccessLog: c.LogConfig.Access,
-		ErrorLog:  c.LogConfig.Output,
+// getCore creates the Xray instance for serverconfig. Errors of the server
+// config are returned as *ConfigError, others wrap ErrInstance.
+func getCore(c *conf.Conf, serverconfig *panel.ServerConfigResponse) (*core.Instance, error) {
+	config, err := buildCoreConfig(c, serverconfig)
+	if err != nil {
+		return nil, newConfigError("config", -1, err)
+	}
+	server, err := core.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: create instance: %w", ErrInstance, err)
 	}
+	return server, nil
+}
+
+// buildCoreConfig builds the Xray config without inbounds, they are added
+// by the nodes.
+func buildCoreConfig(c *conf.Conf, serverconfig *panel.ServerConfigResponse) (*core.Config, error) {
+	// Log Config
+	coreLogConfig := buildLogConfig(c)
 	// Custom config
 	dnsConfig, outBoundConfig, routeConfig, err := GetCustomConfig(serverconfig)
 	if err != nil {
-		log.WithField("err", err).Panic("failed to build custom config")
+		return nil, err
 	}
 	// Inbound config
 	var inBoundConfig []*core.InboundHandlerConfig
 
 	// Policy config
-	levelPolicyConfig := &coreConf.Policy{
-		StatsUserUplink:   true,
-		StatsUserDownlink: true,
-		Handshake:         proto.Uint32(4),
-		ConnectionIdle:    proto.Uint32(30),
-		UplinkOnly:        proto.Uint32(2),
-		DownlinkOnly:      proto.Uint32(4),
-		BufferSize:        proto.Int32(64),
-	}
-	corePolicyConfig := &coreConf.PolicyConfig{}
-	corePolicyConfig.Levels = map[uint32]*coreConf.Policy{0: levelPolicyConfig}
-	policyConfig, _ := corePolicyConfig.Build()
+	policyConfig, _ := buildPolicyConfig().Build()
 	// Build Xray conf
 	config := &core.Config{
 		App: []*serial.TypedMessage{
@@ -125,17 +217,36 @@ func getCore(c *conf.Conf, serverconfig *panel.ServerConfigResponse) *core.Insta
 			serial.ToTypedMessage(&proxyman.InboundConfig{}),
 			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
 			serial.ToTypedMessage(policyConfig),
-			serial.ToTypedMessage(dnsConfig),
+			serial.ToTypedMessage(&dns.Config{Settings: dnsConfig}),
 			serial.ToTypedMessage(routeConfig),
 		},
 		Inbound:  inBoundConfig,
 		Outbound: outBoundConfig,
 	}
-	server, err := core.New(config)
-	if err != nil {
-		log.WithField("err", err).Panic("failed to create instance")
+	return config, nil
+}
+
+func buildLogConfig(c *conf.Conf) *coreConf.LogConfig {
+	return &coreConf.LogConfig{
+		LogLevel:  c.LogConfig.Level,
+		AccessLog: c.LogConfig.Access,
+		ErrorLog:  c.LogConfig.Output,
 	}
-	return server
+}
+
+func buildPolicyConfig() *coreConf.PolicyConfig {
+	levelPolicyConfig := &coreConf.Policy{
+		StatsUserUplink:   true,
+		StatsUserDownlink: true,
+		Handshake:         proto.Uint32(4),
+		ConnectionIdle:    proto.Uint32(30),
+		UplinkOnly:        proto.Uint32(2),
+		DownlinkOnly:      proto.Uint32(4),
+		BufferSize:        proto.Int32(64),
+	}
+	corePolicyConfig := &coreConf.PolicyConfig{}
+	corePolicyConfig.Levels = map[uint32]*coreConf.Policy{0: levelPolicyConfig}
+	return corePolicyConfig
 }
 
 func (c *XrayCore) startTasks(serverconfig *panel.ServerConfigResponse) {
@@ -145,6 +256,7 @@ func (c *XrayCore) startTasks(serverconfig *panel.ServerConfigResponse) {
 		pullinverval = 60
 	}
 	c.serverConfigMonitorPeriodic = &task.Task{
+		Name:     "serverConfigMonitor",
 		Interval: time.Duration(pullinverval) * time.Second,
 		Execute:  c.ServerConfigMonitor,
 		ReloadCh: c.ReloadCh,
@@ -153,12 +265,22 @@ func (c *XrayCore) startTasks(serverconfig *panel.ServerConfigResponse) {
 }
 
 func (c *XrayCore) ServerConfigMonitor(ctx context.Context) (err error) {
-	newServerConfig, err := panel.GetServerConfig(ctx, c.Client)
+	newServerConfig, err := c.Provider.GetServerConfig(ctx)
 	if err != nil {
 		log.WithField("err", err).Error("获取服务端配置失败")
-		return nil
+		return task.ErrFailed
 	}
 	if newServerConfig != nil {
+		// Prefer applying the change in place, fall back to a full reload
+		// when nobody consumes updates or one is already queued
+		if c.UpdateCh != nil {
+			select {
+			case c.UpdateCh <- newServerConfig:
+				log.Warn("检测到服务端配置变更，正在更新节点...")
+				return nil
+			default:
+			}
+		}
 		log.Error("检测到服务端配置变更，正在重启节点...")
 		// Non-blocking signal to avoid goroutine stuck when channel is full or nil
 		if c.ReloadCh != nil {
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	"github.com/xtls/xray-core/features/dns"
+)
+
+func TestUpdateReplacesDNS(t *testing.T) {
+	protocols := []panel.Protocol{}
+	xcore := New(conf.New(), nil)
+	if err := xcore.Start(&panel.ServerConfigResponse{
+		Data: &panel.Data{IPStrategy: "prefer_ipv4", Protocols: &protocols},
+	}); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer xcore.Close()
+	client := xcore.Server.GetFeature(dns.ClientType())
+
+	servers := []panel.DNSItem{{Proto: "udp", Address: "192.0.2.53", Domains: []string{"suffix:example.com"}}}
+	err := xcore.Update(&panel.ServerConfigResponse{
+		Data: &panel.Data{IPStrategy: "prefer_ipv6", DNS: &servers, Protocols: &protocols},
+	})
+	if err != nil {
+		t.Fatalf("Update() error: %v", err)
+	}
+	// The features keep the client they got at start
+	if got := xcore.Server.GetFeature(dns.ClientType()); got != client {
+		t.Fatal("DNS client replaced, want its servers replaced")
+	}
+	if got := xcore.ServerConfig().Data.IPStrategy; got != "prefer_ipv6" {
+		t.Fatalf("IPStrategy = %q after the update, want prefer_ipv6", got)
+	}
+}
@@ -0,0 +1,167 @@
+package limiter
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// userDevices are the devices a user connected from on the node.
+type userDevices struct {
+	access  sync.Mutex
+	uid     int
+	seen    map[string]time.Time // Key: device, value: last connection
+	evicted map[string]time.Time // Key: device, value: when its links are closed
+}
+
+// Eviction is a device evicted from a user at its device limit.
+type Eviction struct {
+	TagUUID string
+	UID     int
+	Device  string
+}
+
+// DeviceOf returns the device of ip, its network when IPs are grouped.
+func (l *Limiter) DeviceOf(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := l.DeviceIPv6Prefix
+	if addr.Is4() {
+		bits = l.DeviceIPv4Prefix
+	}
+	if bits <= 0 {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// checkDevice records ip as an online device of the user taguuid and
+// reports whether the link must be refused for the device limit. A device
+// the user connected from since the last but one report is not counted
+// again. The devices of the user on the node count when the alive list,
+// which counts all nodes, has fewer or is empty.
+func (l *Limiter) checkDevice(taguuid string, ip string, uid int, deviceLimit int) bool {
+	v, _ := l.devices.LoadOrStore(taguuid, &userDevices{
+		uid:     uid,
+		seen:    make(map[string]time.Time),
+		evicted: make(map[string]time.Time),
+	})
+	devices := v.(*userDevices)
+	devices.access.Lock()
+	defer devices.access.Unlock()
+
+	now := time.Now()
+	device := l.DeviceOf(ip)
+	if _, ok := devices.seen[device]; ok {
+		devices.seen[device] = now
+		l.storeOnlineIP(taguuid, ip, uid, device)
+		return false
+	}
+	if expire, ok := devices.evicted[device]; ok && now.Before(expire) {
+		// An evicted device keeps working until its links are closed
+		return false
+	}
+	if deviceLimit > 0 && deviceLimit <= max(l.AliveIP(uid), len(devices.seen)) {
+		if !l.DeviceEvict {
+			return true
+		}
+		oldest := ""
+		for d, seen := range devices.seen {
+			if oldest == "" || seen.Before(devices.seen[oldest]) {
+				oldest = d
+			}
+		}
+		if oldest == "" {
+			// The devices of the user are online on other nodes
+			return true
+		}
+		delete(devices.seen, oldest)
+		devices.evicted[oldest] = now.Add(l.DeviceGrace)
+		l.deleteOnlineIPs(taguuid, oldest)
+	}
+	devices.seen[device] = now
+	l.storeOnlineIP(taguuid, ip, uid, device)
+	return false
+}
+
+// storeOnlineIP records ip as online for the user taguuid, unless another
+// IP of its device already is, so each device is reported once.
+func (l *Limiter) storeOnlineIP(taguuid string, ip string, uid int, device string) {
+	v, _ := l.UserOnlineIP.LoadOrStore(taguuid, new(sync.Map))
+	ipMap := v.(*sync.Map)
+	if l.DeviceIPv4Prefix > 0 || l.DeviceIPv6Prefix > 0 {
+		online := false
+		ipMap.Range(func(key, _ interface{}) bool {
+			online = l.DeviceOf(key.(string)) == device
+			return !online
+		})
+		if online {
+			return
+		}
+	}
+	ipMap.Store(ip, uid)
+}
+
+// deleteOnlineIPs removes the IPs of device from the online IPs of the user
+// taguuid.
+func (l *Limiter) deleteOnlineIPs(taguuid string, device string) {
+	v, ok := l.UserOnlineIP.Load(taguuid)
+	if !ok {
+		return
+	}
+	v.(*sync.Map).Range(func(key, _ interface{}) bool {
+		if l.DeviceOf(key.(string)) == device {
+			v.(*sync.Map).Delete(key)
+		}
+		return true
+	})
+}
+
+// DueEvictions returns the evicted devices whose links must be closed at
+// now.
+func (l *Limiter) DueEvictions(now time.Time) []Eviction {
+	var evictions []Eviction
+	l.devices.Range(func(key, value interface{}) bool {
+		devices := value.(*userDevices)
+		devices.access.Lock()
+		defer devices.access.Unlock()
+		for device, expire := range devices.evicted {
+			if now.Before(expire) {
+				continue
+			}
+			delete(devices.evicted, device)
+			evictions = append(evictions, Eviction{
+				TagUUID: key.(string),
+				UID:     devices.uid,
+				Device:  device,
+			})
+		}
+		return true
+	})
+	return evictions
+}
+
+// pruneDevices forgets the devices that did not connect since the previous
+// call, it is called on each online report.
+func (l *Limiter) pruneDevices() {
+	now := time.Now()
+	l.devices.Range(func(_, value interface{}) bool {
+		devices := value.(*userDevices)
+		devices.access.Lock()
+		defer devices.access.Unlock()
+		for device, seen := range devices.seen {
+			if seen.Before(l.devicesReset) {
+				delete(devices.seen, device)
+			}
+		}
+		return true
+	})
+	l.devicesReset = now
+}
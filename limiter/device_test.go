@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/format"
+)
+
+func TestCheckLimitEvictsDevice(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{{Id: 1, Uuid: "user", DeviceLimit: 2}}
+	l := AddLimiter("tag", users, map[int]int{1: 2})
+	taguuid := format.UserTag("tag", "user")
+	l.DeviceIPv4Prefix = 24
+	l.DeviceGrace = time.Hour
+
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.0.1", true, true); !reject {
+		t.Fatal("CheckLimit() admitted a new device at the limit")
+	}
+
+	l.DeviceEvict = true
+	l.SetAliveList(map[int]int{})
+	for _, ip := range []string{"10.0.0.1", "10.0.1.1"} {
+		if _, _, reject := l.CheckLimit(taguuid, ip, true, true); reject {
+			t.Fatalf("CheckLimit(%s) rejected under the limit", ip)
+		}
+	}
+	l.SetAliveList(map[int]int{1: 2})
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.2.1", true, true); reject {
+		t.Fatal("CheckLimit() rejected, want the oldest device evicted")
+	}
+	// Another IP of the household is the same device
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.2.99", true, true); reject {
+		t.Fatal("CheckLimit() rejected an IP of a known network")
+	}
+	if ips := l.UserOnlineIPs(taguuid); len(ips) != 2 {
+		t.Fatalf("UserOnlineIPs() = %v, want one IP per online device", ips)
+	}
+	// The evicted devices keep working during the grace period
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.0.2", true, true); reject {
+		t.Fatal("CheckLimit() rejected an evicted device in its grace period")
+	}
+	if evictions := l.DueEvictions(time.Now()); len(evictions) != 0 {
+		t.Fatalf("DueEvictions() = %+v before the grace period ended", evictions)
+	}
+	evictions := l.DueEvictions(time.Now().Add(time.Hour))
+	if len(evictions) != 1 || evictions[0].Device != "10.0.0.0/24" || evictions[0].UID != 1 {
+		t.Fatalf("DueEvictions() = %+v, want 10.0.0.0/24 of user 1", evictions)
+	}
+}
+
+func TestCheckLimitWithoutAliveList(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{{Id: 1, Uuid: "user", DeviceLimit: 2}}
+	l := AddLimiter("tag", users, map[int]int{})
+	taguuid := format.UserTag("tag", "user")
+
+	// The devices on the node are counted when the alive list is empty
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, _, reject := l.CheckLimit(taguuid, ip, true, true); reject {
+			t.Fatalf("CheckLimit(%s) rejected under the limit", ip)
+		}
+	}
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.0.3", true, true); !reject {
+		t.Fatal("CheckLimit() admitted a device over the limit")
+	}
+	if _, _, reject := l.CheckLimit(taguuid, "10.0.0.1", true, true); reject {
+		t.Fatal("CheckLimit() rejected a known device")
+	}
+}
@@ -4,16 +4,20 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/juju/ratelimit"
 	"github.com/perfect-panel/ppanel-node/api/panel"
 	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/common/rate"
 )
 
 var limitLock sync.RWMutex
 var limiter map[string]*Limiter
 
+// nodeGroups share the speed limit of the machine between all users
+var nodeGroups speedGroups
+
 func Init() {
 	limiter = map[string]*Limiter{}
 }
@@ -21,20 +25,83 @@ func Init() {
 type Limiter struct {
 	SpeedLimit    int
 	UserOnlineIP  *sync.Map      // Key: TagUUID, value: {Key: Ip, value: Uid}
-	OldUserOnline *sync.Map      // Key: Ip, value: Uid
 	UUIDtoUID     map[string]int // Key: UUID, value: Uid
 	UserLimitInfo *sync.Map      // Key: TagUUID, value: UserLimitInfo
-	SpeedLimiter  *sync.Map      // key: TagUUID, value: *ratelimit.Bucket
+	SpeedLimiter  *sync.Map      // key: TagUUID, value: *Buckets
 	AliveList     map[int]int    // Key: Uid, value: alive_ip
+	aliveLock     sync.RWMutex
+	// QuotaSpeedLimit is the speed limit of users over their quota, they
+	// are refused when it is zero
+	QuotaSpeedLimit int
+	groups          speedGroups // share the speed limit of the inbound
+	// ConnLimit and IPConnLimit cap the open links of each user, in total
+	// and from one IP, zero is unlimited
+	ConnLimit   int
+	IPConnLimit int
+	// Burst is the MB a user bucket holds, one second of its limit when
+	// zero. RefillInterval is how often it is refilled, one second when
+	// zero. The first FullSpeed MB of each link skip the user bucket.
+	Burst          int
+	RefillInterval time.Duration
+	FullSpeed      int
+	// DeviceEvict admits a new device of a user at its device limit by
+	// evicting the least recently connected device of the user, whose links
+	// are closed after DeviceGrace. DeviceIPv4Prefix and DeviceIPv6Prefix
+	// count the IPs of a network as one device, zero does not group.
+	DeviceEvict      bool
+	DeviceGrace      time.Duration
+	DeviceIPv4Prefix int
+	DeviceIPv6Prefix int
+	devices          sync.Map // Key: TagUUID, value: *userDevices
+	devicesReset     time.Time
+	schedules        atomic.Pointer[[]*Schedule]
+	scheduled        []*Schedule    // the schedules the buckets follow
+	reconnect        map[string]int // Key: TagUUID, value: Uid, see Reconnects
+	// updateLock serialises the updates of UserLimitInfo and the re-rating
+	// of the buckets. A UserLimitInfo is never changed once stored, updates
+	// store a changed copy, so CheckLimit reads it without locking.
+	updateLock sync.Mutex
+}
+
+// Buckets are the speed limits of a user, nil for an unlimited direction so
+// its links can splice. They are kept while the user is, so the links of the
+// user follow any change of its limits.
+type Buckets struct {
+	Up   *rate.Bucket
+	Down *rate.Bucket
+}
+
+// speedGroups share a speed limit per direction, nil when it is unlimited.
+// The limits set are lowered to total by the active schedules.
+type speedGroups struct {
+	up        atomic.Pointer[rate.Group]
+	down      atomic.Pointer[rate.Group]
+	access    sync.Mutex
+	limit     int
+	upLimit   int
+	downLimit int
+	total     int
 }
 
 type UserLimitInfo struct {
 	UID               int
 	SpeedLimit        int
+	UpSpeedLimit      int
+	DownSpeedLimit    int
 	DeviceLimit       int
+	ConnLimit         int
+	Burst             int
+	FullSpeed         int
 	DynamicSpeedLimit int
+	Group             string
 	ExpireTime        int64
-	OverLimit         bool
+	// Quota is the traffic allowance in bytes, zero is unlimited. The
+	// traffic used is QuotaUsed plus the traffic of the user counted on the
+	// node since its counter was at QuotaBase.
+	Quota     int64
+	QuotaUsed int64
+	QuotaBase int64
+	OverLimit bool
 }
 
 func AddLimiter(tag string, users []panel.UserInfo, aliveList map[int]int) *Limiter {
@@ -43,20 +110,16 @@ func AddLimiter(tag string, users []panel.UserInfo, aliveList map[int]int) *Limi
 		UserLimitInfo: new(sync.Map),
 		SpeedLimiter:  new(sync.Map),
 		AliveList:     aliveList,
-		OldUserOnline: new(sync.Map),
 	}
 	uuidmap := make(map[string]int)
 	for i := range users {
 		uuidmap[users[i].Uuid] = users[i].Id
 		userLimit := &UserLimitInfo{}
 		userLimit.UID = users[i].Id
-		if users[i].SpeedLimit != 0 {
-			userLimit.SpeedLimit = users[i].SpeedLimit
-		}
-		if users[i].DeviceLimit != 0 {
-			userLimit.DeviceLimit = users[i].DeviceLimit
-		}
-		userLimit.OverLimit = false
+		userLimit.setLimits(&users[i])
+		userLimit.Quota = users[i].Quota
+		userLimit.QuotaUsed = users[i].Used
+		userLimit.OverLimit = overQuota(&users[i])
 		info.UserLimitInfo.Store(format.UserTag(tag, users[i].Uuid), userLimit)
 	}
 	info.UUIDtoUID = uuidmap
@@ -66,6 +129,18 @@ func AddLimiter(tag string, users []panel.UserInfo, aliveList map[int]int) *Limi
 	return info
 }
 
+// setLimits sets the limits of the user from the user list.
+func (u *UserLimitInfo) setLimits(user *panel.UserInfo) {
+	u.SpeedLimit = user.SpeedLimit
+	u.UpSpeedLimit = user.UpSpeedLimit
+	u.DownSpeedLimit = user.DownSpeedLimit
+	u.DeviceLimit = user.DeviceLimit
+	u.ConnLimit = user.ConnLimit
+	u.Burst = user.Burst
+	u.FullSpeed = user.FullSpeed
+	u.Group = user.Group
+}
+
 func GetLimiter(tag string) (info *Limiter, err error) {
 	limitLock.RLock()
 	info, ok := limiter[tag]
@@ -83,99 +158,405 @@ func DeleteLimiter(tag string) {
 }
 
 func (l *Limiter) UpdateUser(tag string, added []panel.UserInfo, deleted []panel.UserInfo) {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
 	for i := range deleted {
 		l.UserLimitInfo.Delete(format.UserTag(tag, deleted[i].Uuid))
 		l.UserOnlineIP.Delete(format.UserTag(tag, deleted[i].Uuid))
 		l.SpeedLimiter.Delete(format.UserTag(tag, deleted[i].Uuid))
+		l.devices.Delete(format.UserTag(tag, deleted[i].Uuid))
+		delete(l.reconnect, format.UserTag(tag, deleted[i].Uuid))
 		delete(l.UUIDtoUID, deleted[i].Uuid)
+		l.aliveLock.Lock()
 		delete(l.AliveList, deleted[i].Id)
+		l.aliveLock.Unlock()
 	}
 	for i := range added {
 		userLimit := &UserLimitInfo{
 			UID: added[i].Id,
 		}
-		if added[i].SpeedLimit != 0 {
-			userLimit.SpeedLimit = added[i].SpeedLimit
-			userLimit.ExpireTime = 0
-		}
-		if added[i].DeviceLimit != 0 {
-			userLimit.DeviceLimit = added[i].DeviceLimit
-		}
-		userLimit.OverLimit = false
+		userLimit.setLimits(&added[i])
+		userLimit.Quota = added[i].Quota
+		userLimit.QuotaUsed = added[i].Used
+		userLimit.OverLimit = overQuota(&added[i])
 		l.UserLimitInfo.Store(format.UserTag(tag, added[i].Uuid), userLimit)
 		l.UUIDtoUID[added[i].Uuid] = added[i].Id
 	}
 }
 
-func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool) (Bucket *ratelimit.Bucket, Reject bool) {
+// UpdateLimits applies the changed limits of users to the running limiter.
+// The buckets of the users are re-rated, so their open links follow the new
+// speed limits, see Reconnects for users that were unlimited. Other limits
+// apply to new links.
+func (l *Limiter) UpdateLimits(tag string, users []panel.UserInfo) {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	for i := range users {
+		taguuid := format.UserTag(tag, users[i].Uuid)
+		u := l.updateUser(taguuid, func(u *UserLimitInfo) {
+			u.setLimits(&users[i])
+		})
+		if u != nil {
+			l.rerateUser(taguuid, u)
+		}
+	}
+}
+
+// updateUser stores a copy of the limits of the user taguuid changed by
+// update and returns it, nil when the user is unknown. l.updateLock must be
+// held.
+func (l *Limiter) updateUser(taguuid string, update func(u *UserLimitInfo)) *UserLimitInfo {
+	v, ok := l.UserLimitInfo.Load(taguuid)
+	if !ok {
+		return nil
+	}
+	u := *v.(*UserLimitInfo)
+	update(&u)
+	l.UserLimitInfo.Store(taguuid, &u)
+	return &u
+}
+
+// SetAliveList replaces the number of IPs each user is online with on all
+// nodes, which is counted against the device limit.
+func (l *Limiter) SetAliveList(alive map[int]int) {
+	l.aliveLock.Lock()
+	l.AliveList = alive
+	l.aliveLock.Unlock()
+}
+
+// AliveIP returns the number of IPs the user uid is online with on all nodes.
+func (l *Limiter) AliveIP(uid int) int {
+	l.aliveLock.RLock()
+	defer l.aliveLock.RUnlock()
+	return l.AliveList[uid]
+}
+
+// SetDynamicSpeedLimit limits the user to limit Mbps until expire, a zero
+// limit removes the dynamic limit. The buckets of the user are re-rated, so
+// the limit applies to its open links, see Reconnects.
+func (l *Limiter) SetDynamicSpeedLimit(taguuid string, limit int, expire time.Time) error {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	u := l.updateUser(taguuid, func(u *UserLimitInfo) {
+		if limit > 0 {
+			u.DynamicSpeedLimit = limit
+			u.ExpireTime = expire.Unix()
+		} else {
+			u.DynamicSpeedLimit = 0
+			u.ExpireTime = 0
+		}
+	})
+	if u == nil {
+		return errors.New("not found")
+	}
+	l.rerateUser(taguuid, u)
+	return nil
+}
+
+// ExpireDynamicLimits removes the dynamic limits expired at now and
+// re-rates the buckets of their users. It returns how many were removed.
+func (l *Limiter) ExpireDynamicLimits(now time.Time) int {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	expired := 0
+	l.UserLimitInfo.Range(func(key, value interface{}) bool {
+		if !value.(*UserLimitInfo).dynamicExpired(now) {
+			return true
+		}
+		u := l.updateUser(key.(string), func(u *UserLimitInfo) {
+			u.DynamicSpeedLimit = 0
+			u.ExpireTime = 0
+		})
+		l.rerateUser(key.(string), u)
+		expired++
+		return true
+	})
+	return expired
+}
+
+// dynamicExpired reports whether the dynamic limit of the user expired at
+// now.
+func (u *UserLimitInfo) dynamicExpired(now time.Time) bool {
+	return u.ExpireTime != 0 && u.ExpireTime < now.Unix()
+}
+
+// SetNodeSpeedLimit shares limit Mbps in each direction fairly between the
+// users of all inbounds. up and down lower the limit of one direction, zero
+// is unlimited.
+func SetNodeSpeedLimit(limit, up, down int) {
+	nodeGroups.set(limit, up, down)
+}
+
+// SetInboundSpeedLimit shares limit Mbps in each direction fairly between
+// the users of the inbound. up and down lower the limit of one direction,
+// zero is unlimited.
+func (l *Limiter) SetInboundSpeedLimit(limit, up, down int) {
+	l.groups.set(limit, up, down)
+}
+
+func (g *speedGroups) set(limit, up, down int) {
+	g.access.Lock()
+	defer g.access.Unlock()
+	g.limit, g.upLimit, g.downLimit = limit, up, down
+	g.apply()
+}
+
+// schedule lowers the speed limits of the groups to total Mbps, zero
+// restores them.
+func (g *speedGroups) schedule(total int) {
+	g.access.Lock()
+	defer g.access.Unlock()
+	g.total = total
+	g.apply()
+}
+
+func (g *speedGroups) apply() {
+	limit := determineSpeedLimit(g.limit, g.total)
+	setGroupSpeedLimit(&g.up, determineSpeedLimit(limit, g.upLimit))
+	setGroupSpeedLimit(&g.down, determineSpeedLimit(limit, g.downLimit))
+}
+
+func setGroupSpeedLimit(group *atomic.Pointer[rate.Group], limit int) {
+	if limit <= 0 {
+		group.Store(nil)
+		return
+	}
+	bytes := int64(limit) * 1000000 / 8
+	if g := group.Load(); g != nil {
+		g.SetRate(bytes)
+		return
+	}
+	group.Store(rate.NewGroup(bytes))
+}
+
+// ConnLimits returns how many links the user taguuid may have open, in total
+// and from one IP, zero is unlimited.
+func (l *Limiter) ConnLimits(taguuid string) (user int, ip int) {
+	user = l.ConnLimit
+	if v, ok := l.UserLimitInfo.Load(taguuid); ok {
+		user = determineSpeedLimit(user, v.(*UserLimitInfo).ConnLimit)
+	}
+	return user, l.IPConnLimit
+}
+
+// CheckLimit returns the limiters of the upload and download of a new link
+// of the user taguuid from ip, nil when unlimited, or rejects the link.
+func (l *Limiter) CheckLimit(taguuid string, ip string, isTcp bool, noSSUDP bool) (Up rate.Limiter, Down rate.Limiter, Reject bool) {
 	// check if ipv4 mapped ipv6
 	ip = strings.TrimPrefix(ip, "::ffff:")
 
 	// check and gen speed limit Bucket
-	nodeLimit := l.SpeedLimit
-	userLimit := 0
-	deviceLimit := 0
-	var uid int
-	if v, ok := l.UserLimitInfo.Load(taguuid); ok {
-		u := v.(*UserLimitInfo)
-		deviceLimit = u.DeviceLimit
-		uid = u.UID
-		if u.ExpireTime < time.Now().Unix() && u.ExpireTime != 0 {
-			if u.SpeedLimit != 0 {
-				userLimit = u.SpeedLimit
-				u.DynamicSpeedLimit = 0
-				u.ExpireTime = 0
-			} else {
-				l.UserLimitInfo.Delete(taguuid)
-			}
-		} else {
-			userLimit = determineSpeedLimit(u.SpeedLimit, u.DynamicSpeedLimit)
+	now := time.Now()
+	v, ok := l.UserLimitInfo.Load(taguuid)
+	if !ok {
+		return nil, nil, true
+	}
+	u := v.(*UserLimitInfo)
+	fullSpeed := l.FullSpeed
+	if u.FullSpeed > 0 {
+		fullSpeed = u.FullSpeed
+	}
+	if u.OverLimit && l.QuotaSpeedLimit == 0 {
+		return nil, nil, true
+	}
+	if noSSUDP && l.checkDevice(taguuid, ip, u.UID, u.DeviceLimit) {
+		return nil, nil, true
+	}
+
+	buckets := l.buckets(taguuid, now)
+	Up = joinLimiters(taguuid, linkLimiter(buckets.Up, fullSpeed), &l.groups.up, &nodeGroups.up)
+	Down = joinLimiters(taguuid, linkLimiter(buckets.Down, fullSpeed), &l.groups.down, &nodeGroups.down)
+	return Up, Down, false
+}
+
+// buckets returns the buckets of the user taguuid. When it has none they are
+// created at its speed limits under the schedules active at now.
+func (l *Limiter) buckets(taguuid string, now time.Time) *Buckets {
+	if v, ok := l.SpeedLimiter.Load(taguuid); ok {
+		return v.(*Buckets)
+	}
+	// Under the lock the limits can not change before the buckets are stored
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	if v, ok := l.SpeedLimiter.Load(taguuid); ok {
+		return v.(*Buckets)
+	}
+	v, ok := l.UserLimitInfo.Load(taguuid)
+	if !ok {
+		// Deleted meanwhile
+		return &Buckets{}
+	}
+	u := v.(*UserLimitInfo)
+	active := append(activeSchedules(nodeSchedules.Load(), now), activeSchedules(l.schedules.Load(), now)...)
+	up, down := l.speedLimits(u, active)
+	if up <= 0 && down <= 0 {
+		return &Buckets{}
+	}
+	burst := l.burst(u)
+	buckets := &Buckets{
+		Up:   newBucket(up, burst, l.RefillInterval),
+		Down: newBucket(down, burst, l.RefillInterval),
+	}
+	l.SpeedLimiter.Store(taguuid, buckets)
+	return buckets
+}
+
+// speedLimits returns the speed limits of the user u in Mbps under the
+// active schedules, zero is unlimited.
+func (l *Limiter) speedLimits(u *UserLimitInfo, active []*Schedule) (up int, down int) {
+	userLimit := u.SpeedLimit
+	if !u.dynamicExpired(time.Now()) {
+		// An expired limit no longer applies before it is removed
+		userLimit = determineSpeedLimit(userLimit, u.DynamicSpeedLimit)
+	}
+	if u.OverLimit {
+		userLimit = determineSpeedLimit(userLimit, l.QuotaSpeedLimit)
+	}
+	limit := determineSpeedLimit(l.SpeedLimit, userLimit) // If you need the Speed limit
+	up = determineSpeedLimit(limit, u.UpSpeedLimit)
+	down = determineSpeedLimit(limit, u.DownSpeedLimit)
+	for _, s := range active {
+		up = s.lower(u.Group, up)
+		down = s.lower(u.Group, down)
+	}
+	return up, down
+}
+
+// burst returns the MB the buckets of the user u hold, zero for one second
+// of their limit.
+func (l *Limiter) burst(u *UserLimitInfo) int {
+	if u.Burst > 0 {
+		return u.Burst
+	}
+	return l.Burst
+}
+
+// bucketSize returns the rate in bytes per second and the capacity in bytes
+// of a bucket of limit Mbps holding burst MB.
+func bucketSize(limit int, burst int) (bytes int64, capacity int64) {
+	bytes = int64(limit) * 1000000 / 8 // Byte/s
+	capacity = bytes
+	if burst > 0 {
+		capacity = int64(burst) * 1000000
+	}
+	return bytes, capacity
+}
+
+// newBucket returns a bucket of limit Mbps holding burst MB and refilled
+// every interval, nil when unlimited.
+func newBucket(limit int, burst int, interval time.Duration) *rate.Bucket {
+	if limit <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	bucket := rate.NewBucketWithInterval(interval, 0, 0)
+	setBucketRate(bucket, limit, burst)
+	return bucket
+}
+
+// rerate re-rates the buckets of the user taguuid to its limits u under the
+// active schedules. The links of a direction that was unlimited have no
+// bucket: the buckets are dropped and the user is queued for Reconnects.
+// l.updateLock must be held.
+func (l *Limiter) rerate(taguuid string, u *UserLimitInfo, active []*Schedule) {
+	up, down := l.speedLimits(u, active)
+	buckets := &Buckets{}
+	if v, ok := l.SpeedLimiter.Load(taguuid); ok {
+		buckets = v.(*Buckets)
+	}
+	if up > 0 && buckets.Up == nil || down > 0 && buckets.Down == nil {
+		l.SpeedLimiter.Delete(taguuid)
+		if l.reconnect == nil {
+			l.reconnect = make(map[string]int)
 		}
-	} else {
-		return nil, true
-	}
-	if noSSUDP {
-		// Store online user for device limit
-		ipMap := new(sync.Map)
-		ipMap.Store(ip, uid)
-		aliveIp := l.AliveList[uid]
-		// If any device is online
-		if v, ok := l.UserOnlineIP.LoadOrStore(taguuid, ipMap); ok {
-			ipMap := v.(*sync.Map)
-			// If this is a new ip
-			if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
-				if deviceLimit > 0 {
-					if deviceLimit <= aliveIp {
-						ipMap.Delete(ip)
-						return nil, true
-					}
-				}
-			}
-		} else if v, ok := l.OldUserOnline.Load(ip); ok {
-			if v.(int) == uid {
-				l.OldUserOnline.Delete(ip)
-			}
+		l.reconnect[taguuid] = u.UID
+		return
+	}
+	burst := l.burst(u)
+	setBucketRate(buckets.Up, up, burst)
+	setBucketRate(buckets.Down, down, burst)
+	if up <= 0 && buckets.Up != nil || down <= 0 && buckets.Down != nil {
+		// The open links keep the bucket of a direction now unlimited, at
+		// rate zero, new links go without
+		kept := &Buckets{}
+		if up > 0 {
+			kept.Up = buckets.Up
+		}
+		if down > 0 {
+			kept.Down = buckets.Down
+		}
+		if kept.Up == nil && kept.Down == nil {
+			l.SpeedLimiter.Delete(taguuid)
 		} else {
-			if deviceLimit > 0 {
-				if deviceLimit <= aliveIp {
-					l.UserOnlineIP.Delete(taguuid)
-					return nil, true
-				}
-			}
+			l.SpeedLimiter.Store(taguuid, kept)
 		}
 	}
+}
 
-	limit := int64(determineSpeedLimit(nodeLimit, userLimit)) * 1000000 / 8 // If you need the Speed limit
-	if limit > 0 {
-		Bucket = ratelimit.NewBucketWithQuantum(time.Second, limit, limit) // Byte/s
-		if v, ok := l.SpeedLimiter.LoadOrStore(taguuid, Bucket); ok {
-			return v.(*ratelimit.Bucket), false
-		} else {
-			l.SpeedLimiter.Store(taguuid, Bucket)
-			return Bucket, false
+// rerateUser re-rates the buckets of the user taguuid to its limits u under
+// the schedules the buckets follow. l.updateLock must be held.
+func (l *Limiter) rerateUser(taguuid string, u *UserLimitInfo) {
+	l.rerate(taguuid, u, l.scheduled)
+}
+
+// Reconnects returns the users whose links must be closed, keyed by TagUUID,
+// as they got a speed limit for a direction their links were opened
+// unlimited in. The links reconnect with buckets at the new limits.
+func (l *Limiter) Reconnects() map[string]int {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	reconnect := l.reconnect
+	l.reconnect = nil
+	return reconnect
+}
+
+// setBucketRate re-rates bucket to limit Mbps holding burst MB, zero is
+// unlimited.
+func setBucketRate(bucket *rate.Bucket, limit int, burst int) {
+	if bucket == nil {
+		return
+	}
+	if limit <= 0 {
+		bucket.SetRate(0, 0)
+		return
+	}
+	bucket.SetRate(bucketSize(limit, burst))
+}
+
+// linkLimiter returns the limiter of a link on bucket, letting the first
+// fullSpeed MB through, nil when bucket is.
+func linkLimiter(bucket *rate.Bucket, fullSpeed int) rate.Limiter {
+	if bucket == nil {
+		return nil
+	}
+	if fullSpeed > 0 {
+		return rate.NewAllowance(int64(fullSpeed)*1000000, bucket)
+	}
+	return bucket
+}
+
+// joinLimiters returns the limiter of one direction of the user taguuid,
+// nil when it is unlimited.
+func joinLimiters(taguuid string, limiter rate.Limiter, groups ...*atomic.Pointer[rate.Group]) rate.Limiter {
+	var limiters rate.Limiters
+	if limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	// Take a fair share of the inbound and machine speed limits
+	for _, group := range groups {
+		if g := group.Load(); g != nil {
+			limiters = append(limiters, g.Member(taguuid))
 		}
-	} else {
-		return nil, false
+	}
+	switch len(limiters) {
+	case 0:
+		return nil
+	case 1:
+		return limiters[0]
+	default:
+		return limiters
 	}
 }
 
@@ -187,17 +568,43 @@ func (l *Limiter) GetOnlineDevice() (*[]panel.OnlineUser, error) {
 		ipMap.Range(func(key, value interface{}) bool {
 			uid := value.(int)
 			ip := key.(string)
-			l.OldUserOnline.Store(ip, uid)
 			onlineUser = append(onlineUser, panel.OnlineUser{UID: uid, IP: ip})
 			return true
 		})
 		l.UserOnlineIP.Delete(taguuid) // Reset online device
 		return true
 	})
+	l.pruneDevices()
 
 	return &onlineUser, nil
 }
 
+// UserOnlineIPs returns the IPs the user is online with since the last report.
+func (l *Limiter) UserOnlineIPs(taguuid string) []string {
+	var ips []string
+	if v, ok := l.UserOnlineIP.Load(taguuid); ok {
+		v.(*sync.Map).Range(func(key, _ interface{}) bool {
+			ips = append(ips, key.(string))
+			return true
+		})
+	}
+	return ips
+}
+
+// OnlineIPs returns the number of IPs each user ID is online with since the
+// last report.
+func (l *Limiter) OnlineIPs() map[int]int {
+	online := make(map[int]int)
+	l.UserOnlineIP.Range(func(_, value interface{}) bool {
+		value.(*sync.Map).Range(func(_, value interface{}) bool {
+			online[value.(int)]++
+			return true
+		})
+		return true
+	})
+	return online
+}
+
 type UserIpList struct {
 	Uid    int      `json:"Uid"`
 	IpList []string `json:"Ips"`
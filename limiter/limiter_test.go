@@ -0,0 +1,177 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/common/rate"
+)
+
+func TestCheckLimitSplitsDirections(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "up", UpSpeedLimit: 8},
+		{Id: 2, Uuid: "both", SpeedLimit: 16, UpSpeedLimit: 8, DownSpeedLimit: 32},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+
+	up, down, reject := l.CheckLimit(format.UserTag("tag", "up"), "127.0.0.1", true, true)
+	if reject || down != nil {
+		t.Fatalf("CheckLimit() = %v, %v, %v, want an unlimited download", up, down, reject)
+	}
+	if got := up.(*rate.Bucket).Rate(); got != 1000000 {
+		t.Fatalf("upload rate = %v, want 1000000 B/s", got)
+	}
+
+	up, down, _ = l.CheckLimit(format.UserTag("tag", "both"), "127.0.0.1", true, true)
+	if got := up.(*rate.Bucket).Rate(); got != 1000000 {
+		t.Fatalf("upload rate = %v, want the lower up limit", got)
+	}
+	if got := down.(*rate.Bucket).Rate(); got != 2000000 {
+		t.Fatalf("download rate = %v, want the lower speed limit", got)
+	}
+
+	l.SetInboundSpeedLimit(0, 0, 100)
+	up, down, _ = l.CheckLimit(format.UserTag("tag", "up"), "127.0.0.1", true, true)
+	if _, ok := up.(*rate.Bucket); !ok {
+		t.Fatalf("upload limiter = %T, want only the user bucket", up)
+	}
+	if _, ok := down.(*rate.Member); !ok {
+		t.Fatalf("download limiter = %T, want a share of the inbound", down)
+	}
+}
+
+func TestCheckLimitBurst(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "default", SpeedLimit: 8},
+		{Id: 2, Uuid: "burst", SpeedLimit: 8, Burst: 4, FullSpeed: 2},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+	l.RefillInterval = 100 * time.Millisecond
+
+	up, _, _ := l.CheckLimit(format.UserTag("tag", "default"), "127.0.0.1", true, true)
+	if got := up.(*rate.Bucket).Capacity(); got != 1000000 {
+		t.Fatalf("capacity = %v, want one second of the limit", got)
+	}
+
+	up, down, _ := l.CheckLimit(format.UserTag("tag", "burst"), "127.0.0.1", true, true)
+	if _, ok := up.(*rate.Allowance); !ok {
+		t.Fatalf("upload limiter = %T, want a full speed allowance", up)
+	}
+	v, _ := l.SpeedLimiter.Load(format.UserTag("tag", "burst"))
+	bucket := v.(*Buckets).Down
+	if got := bucket.Capacity(); got != 4000000 {
+		t.Fatalf("capacity = %v, want the burst of the user", got)
+	}
+	if got := bucket.Rate(); got != 1000000 {
+		t.Fatalf("rate = %v, want 1000000 B/s", got)
+	}
+	// The allowance is per link and does not drain the bucket
+	start := time.Now()
+	down.Wait(2000000)
+	if time.Since(start) > 100*time.Millisecond || bucket.Available() != 4000000 {
+		t.Fatalf("Wait() took %v and left %v, want the allowance used", time.Since(start), bucket.Available())
+	}
+	down.Wait(1000000)
+	if got := bucket.Available(); got != 3000000 {
+		t.Fatalf("available = %v after the allowance, want 3000000", got)
+	}
+}
+
+func TestDynamicSpeedLimitReratesBuckets(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "user", SpeedLimit: 16},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+	taguuid := format.UserTag("tag", "user")
+
+	// The bucket of an open link follows the dynamic limit
+	_, down, _ := l.CheckLimit(taguuid, "127.0.0.1", true, true)
+	bucket := down.(*rate.Bucket)
+	now := time.Now()
+	if err := l.SetDynamicSpeedLimit(taguuid, 8, now.Add(time.Minute)); err != nil {
+		t.Fatalf("SetDynamicSpeedLimit() error: %v", err)
+	}
+	if got := bucket.Rate(); got != 1000000 {
+		t.Fatalf("rate = %v under the dynamic limit, want 1000000 B/s", got)
+	}
+	if n := l.ExpireDynamicLimits(now); n != 0 {
+		t.Fatalf("ExpireDynamicLimits() = %d before the expiry, want 0", n)
+	}
+	if n := l.ExpireDynamicLimits(now.Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("ExpireDynamicLimits() = %d after the expiry, want 1", n)
+	}
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v after the expiry, want the user limit", got)
+	}
+
+	if err := l.SetDynamicSpeedLimit(taguuid, 8, now.Add(time.Minute)); err != nil {
+		t.Fatalf("SetDynamicSpeedLimit() error: %v", err)
+	}
+	if err := l.SetDynamicSpeedLimit(taguuid, 0, time.Time{}); err != nil {
+		t.Fatalf("SetDynamicSpeedLimit() error: %v", err)
+	}
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v after the limit was removed, want the user limit", got)
+	}
+	if err := l.SetDynamicSpeedLimit(format.UserTag("tag", "unknown"), 8, now); err == nil {
+		t.Fatal("SetDynamicSpeedLimit() accepted an unknown user")
+	}
+}
+
+func TestRerateQueuesUnlimitedLinks(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "user"},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+	taguuid := format.UserTag("tag", "user")
+
+	// Links of an unlimited user go without buckets and are reconnected
+	// once the user is limited
+	up, down, _ := l.CheckLimit(taguuid, "127.0.0.1", true, true)
+	if up != nil || down != nil {
+		t.Fatalf("CheckLimit() = %v, %v, want no limiters", up, down)
+	}
+	users[0].DownSpeedLimit = 8
+	l.UpdateLimits("tag", users)
+	if got := l.Reconnects(); got[taguuid] != 1 {
+		t.Fatalf("Reconnects() = %v, want the user", got)
+	}
+	if got := l.Reconnects(); len(got) != 0 {
+		t.Fatalf("Reconnects() = %v again, want none", got)
+	}
+
+	// A limited direction is re-rated in place, a newly limited one is not
+	_, down, _ = l.CheckLimit(taguuid, "127.0.0.1", true, true)
+	bucket := down.(*rate.Bucket)
+	users[0].DownSpeedLimit = 16
+	l.UpdateLimits("tag", users)
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v, want 2000000 B/s", got)
+	}
+	if got := l.Reconnects(); len(got) != 0 {
+		t.Fatalf("Reconnects() = %v after a re-rate, want none", got)
+	}
+	users[0].UpSpeedLimit = 8
+	l.UpdateLimits("tag", users)
+	if got := l.Reconnects(); got[taguuid] != 1 {
+		t.Fatalf("Reconnects() = %v, want the user", got)
+	}
+
+	// Links of a user no longer limited are freed, new ones go without
+	_, down, _ = l.CheckLimit(taguuid, "127.0.0.1", true, true)
+	bucket = down.(*rate.Bucket)
+	users[0].UpSpeedLimit, users[0].DownSpeedLimit = 0, 0
+	l.UpdateLimits("tag", users)
+	if got := bucket.Rate(); got != 0 {
+		t.Fatalf("rate = %v, want unlimited", got)
+	}
+	if up, down, _ := l.CheckLimit(taguuid, "127.0.0.1", true, true); up != nil || down != nil {
+		t.Fatalf("CheckLimit() = %v, %v, want no limiters", up, down)
+	}
+}
@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/counter"
+)
+
+// SetQuota sets the traffic quota of the user taguuid in bytes. used is the
+// traffic already counted against it when the counter of the user on the
+// node was at base bytes, the traffic counted afterwards is added to it.
+func (l *Limiter) SetQuota(taguuid string, quota, used, base int64) {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	l.updateUser(taguuid, func(u *UserLimitInfo) {
+		u.Quota = quota
+		u.QuotaUsed = used
+		u.QuotaBase = base
+	})
+}
+
+// CheckQuota compares the traffic counted by tc against the quota of each
+// user. It returns the UID of the users that went over their quota since the
+// last check, keyed by TagUUID. Users over their quota are refused on their
+// next connection, or throttled to QuotaSpeedLimit at once.
+func (l *Limiter) CheckQuota(tc *counter.TrafficCounter) map[string]int {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	exceeded := make(map[string]int)
+	l.UserLimitInfo.Range(func(key, value interface{}) bool {
+		u := value.(*UserLimitInfo)
+		over := false
+		if u.Quota > 0 {
+			var total int64
+			if tc != nil {
+				if v, ok := tc.Counters.Load(key); ok {
+					ts := v.(*counter.TrafficStorage)
+					total = ts.UpTotal.Load() + ts.DownTotal.Load()
+				}
+			}
+			over = u.QuotaUsed+total-u.QuotaBase >= u.Quota
+		}
+		if over == u.OverLimit {
+			return true
+		}
+		// The quota was used up, raised or reset: re-rate the buckets
+		u = l.updateUser(key.(string), func(u *UserLimitInfo) {
+			u.OverLimit = over
+		})
+		l.rerateUser(key.(string), u)
+		if over {
+			exceeded[key.(string)] = u.UID
+		}
+		return true
+	})
+	return exceeded
+}
+
+// overQuota reports whether the panel counted the quota of user as used up.
+func overQuota(user *panel.UserInfo) bool {
+	return user.Quota > 0 && user.Used >= user.Quota
+}
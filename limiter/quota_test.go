@@ -0,0 +1,54 @@
+package limiter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/common/rate"
+)
+
+// TestQuotaUpdatesWhileChecking updates and checks the quota of a user while
+// links of the user are checked. Run it with -race.
+func TestQuotaUpdatesWhileChecking(t *testing.T) {
+	Init()
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "user", SpeedLimit: 8, Quota: 100},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+	l.QuotaSpeedLimit = 1
+	taguuid := format.UserTag("tag", "user")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			l.SetQuota(taguuid, 100, int64(i%200), 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			l.CheckQuota(nil)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if _, _, reject := l.CheckLimit(taguuid, "127.0.0.1", true, false); reject {
+			t.Fatal("user over the quota rejected, want throttled")
+		}
+	}
+	wg.Wait()
+
+	l.SetQuota(taguuid, 100, 0, 0)
+	l.CheckQuota(nil)
+	l.SetQuota(taguuid, 100, 100, 0)
+	if exceeded := l.CheckQuota(nil); exceeded[taguuid] != 1 {
+		t.Fatalf("CheckQuota() = %v, want user 1 over the quota", exceeded)
+	}
+	up, _, _ := l.CheckLimit(taguuid, "127.0.0.1", true, false)
+	if got := up.(*rate.Bucket).Rate(); got != 125000 {
+		t.Fatalf("upload rate = %v, want the quota speed limit", got)
+	}
+}
@@ -0,0 +1,122 @@
+package limiter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/common/counter"
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+// RuleEngine caps users with the dynamic speed limit of the first rule they
+// match. Users are sampled periodically and a rule only matches once it held
+// on every sample for its whole period.
+type RuleEngine struct {
+	rules   []conf.DynamicRule
+	sampled time.Time
+	traffic map[string]int64       // Key: TagUUID, value: traffic total at the last sample
+	since   map[string][]time.Time // Key: TagUUID, value: since when each rule holds
+}
+
+// Throttle is a user capped by the rule at index Rule. Speed in Mbps and
+// Connections are what the user was sampled at.
+type Throttle struct {
+	TagUUID     string
+	UID         int
+	Rule        int
+	Speed       int
+	Connections int
+	SpeedLimit  int
+	Expire      time.Time
+}
+
+func NewRuleEngine(rules []conf.DynamicRule) (*RuleEngine, error) {
+	for i, rule := range rules {
+		if rule.Speed <= 0 && rule.Connections <= 0 {
+			return nil, fmt.Errorf("rule %d: speed or connections is required", i)
+		}
+		if rule.SpeedLimit <= 0 || rule.Duration <= 0 {
+			return nil, fmt.Errorf("rule %d: speed limit and duration are required", i)
+		}
+	}
+	return &RuleEngine{
+		rules:   rules,
+		traffic: make(map[string]int64),
+		since:   make(map[string][]time.Time),
+	}, nil
+}
+
+// Check samples the traffic of the users of l counted by tc and their open
+// links, keyed by UID, and caps the users matching a rule. It returns the
+// users capped by this check.
+func (e *RuleEngine) Check(l *Limiter, tc *counter.TrafficCounter, links map[int]int, now time.Time) []Throttle {
+	var throttles []Throttle
+	elapsed := now.Sub(e.sampled)
+	first := e.sampled.IsZero() || elapsed <= 0
+	e.sampled = now
+	traffic := make(map[string]int64)
+	l.UserLimitInfo.Range(func(key, value interface{}) bool {
+		taguuid := key.(string)
+		u := value.(*UserLimitInfo)
+		var total int64
+		if tc != nil {
+			if v, ok := tc.Counters.Load(taguuid); ok {
+				ts := v.(*counter.TrafficStorage)
+				total = ts.UpTotal.Load() + ts.DownTotal.Load()
+			}
+		}
+		traffic[taguuid] = total
+		last, ok := e.traffic[taguuid]
+		if first || !ok || total < last || u.ExpireTime > now.Unix() {
+			// no speed to compare yet, or already capped
+			delete(e.since, taguuid)
+			return true
+		}
+		// bits per microsecond are Mbps
+		speed := int((total - last) * 8 / max(elapsed.Microseconds(), 1))
+		connections := links[u.UID]
+		since := e.since[taguuid]
+		if since == nil {
+			since = make([]time.Time, len(e.rules))
+		}
+		holds := false
+		for i, rule := range e.rules {
+			if !(rule.Speed > 0 && speed > rule.Speed) &&
+				!(rule.Connections > 0 && connections > rule.Connections) {
+				since[i] = time.Time{}
+				continue
+			}
+			if since[i].IsZero() {
+				// it held since the previous sample
+				since[i] = now.Add(-elapsed)
+			}
+			if now.Sub(since[i]) < rule.Period {
+				holds = true
+				continue
+			}
+			expire := now.Add(rule.Duration)
+			if err := l.SetDynamicSpeedLimit(taguuid, rule.SpeedLimit, expire); err != nil {
+				break
+			}
+			throttles = append(throttles, Throttle{
+				TagUUID:     taguuid,
+				UID:         u.UID,
+				Rule:        i,
+				Speed:       speed,
+				Connections: connections,
+				SpeedLimit:  rule.SpeedLimit,
+				Expire:      expire,
+			})
+			holds = false
+			break
+		}
+		if !holds {
+			delete(e.since, taguuid)
+		} else {
+			e.since[taguuid] = since
+		}
+		return true
+	})
+	e.traffic = traffic
+	return throttles
+}
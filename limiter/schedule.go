@@ -0,0 +1,159 @@
+package limiter
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+// nodeSchedules lower the speed limits of all inbounds
+var nodeSchedules atomic.Pointer[[]*Schedule]
+
+// Schedule lowers speed limits every day between two local times, see
+// conf.SpeedSchedule.
+type Schedule struct {
+	start           time.Duration // since midnight
+	end             time.Duration
+	groups          map[string]bool
+	percent         int
+	speedLimit      int
+	totalSpeedLimit int
+}
+
+func NewSchedules(schedules []conf.SpeedSchedule) ([]*Schedule, error) {
+	parsed := make([]*Schedule, 0, len(schedules))
+	for i, schedule := range schedules {
+		start, err := parseTimeOfDay(schedule.Start)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: start: %s", i, err)
+		}
+		end, err := parseTimeOfDay(schedule.End)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: end: %s", i, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("schedule %d: start and end are the same", i)
+		}
+		if schedule.Percent < 0 || schedule.Percent > 100 {
+			return nil, fmt.Errorf("schedule %d: percent must be between 0 and 100", i)
+		}
+		if schedule.Percent == 0 && schedule.SpeedLimit <= 0 && schedule.TotalSpeedLimit <= 0 {
+			return nil, fmt.Errorf("schedule %d: percent, speed limit or total speed limit is required", i)
+		}
+		s := &Schedule{
+			start:           start,
+			end:             end,
+			percent:         schedule.Percent,
+			speedLimit:      schedule.SpeedLimit,
+			totalSpeedLimit: schedule.TotalSpeedLimit,
+		}
+		if len(schedule.Groups) > 0 {
+			s.groups = make(map[string]bool, len(schedule.Groups))
+			for _, group := range schedule.Groups {
+				s.groups[group] = true
+			}
+		}
+		parsed = append(parsed, s)
+	}
+	return parsed, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// SetNodeSchedules replaces the schedules lowering the speed limits of all
+// inbounds. Their TotalSpeedLimit lowers the speed limit of the machine.
+func SetNodeSchedules(schedules []*Schedule) {
+	nodeSchedules.Store(&schedules)
+}
+
+// SetSchedules replaces the schedules lowering the speed limits of the
+// inbound. Their TotalSpeedLimit lowers the speed limit of the inbound.
+func (l *Limiter) SetSchedules(schedules []*Schedule) {
+	l.schedules.Store(&schedules)
+}
+
+// active reports whether the schedule is active at now, in the location of
+// now.
+func (s *Schedule) active(now time.Time) bool {
+	t := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	if s.start < s.end {
+		return t >= s.start && t < s.end
+	}
+	return t >= s.start || t < s.end
+}
+
+// lower returns the speed limit of a user of group lowered by the schedule,
+// limit and the result are in Mbps, zero is unlimited.
+func (s *Schedule) lower(group string, limit int) int {
+	if s.groups != nil && !s.groups[group] {
+		return limit
+	}
+	if s.percent > 0 && limit > 0 {
+		limit = max(limit*s.percent/100, 1)
+	}
+	return determineSpeedLimit(limit, s.speedLimit)
+}
+
+// activeSchedules returns the schedules active at now.
+func activeSchedules(schedules *[]*Schedule, now time.Time) []*Schedule {
+	if schedules == nil {
+		return nil
+	}
+	var active []*Schedule
+	for _, s := range *schedules {
+		if s.active(now) {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// totalSpeedLimit returns the lowest TotalSpeedLimit of schedules, zero
+// when none lowers it.
+func totalSpeedLimit(schedules []*Schedule) int {
+	total := 0
+	for _, s := range schedules {
+		total = determineSpeedLimit(total, s.totalSpeedLimit)
+	}
+	return total
+}
+
+// ApplySchedules applies the schedules active at now when they changed: the
+// shared speed limits are lowered or restored and the buckets of the users
+// are re-rated, so open links follow the schedule, see Reconnects for users
+// that were unlimited. It returns how many users with buckets were re-rated,
+// or -1 when the active schedules did not change.
+func (l *Limiter) ApplySchedules(now time.Time) int {
+	node := activeSchedules(nodeSchedules.Load(), now)
+	inbound := activeSchedules(l.schedules.Load(), now)
+	// The machine is shared by all inbounds, setting it again is a no-op
+	nodeGroups.schedule(totalSpeedLimit(node))
+
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	active := append(node, inbound...)
+	if slices.Equal(active, l.scheduled) {
+		return -1
+	}
+	l.scheduled = active
+	l.groups.schedule(totalSpeedLimit(inbound))
+	rerated := 0
+	l.UserLimitInfo.Range(func(key, value interface{}) bool {
+		if _, ok := l.SpeedLimiter.Load(key); ok {
+			rerated++
+		}
+		l.rerate(key.(string), value.(*UserLimitInfo), active)
+		return true
+	})
+	return rerated
+}
@@ -0,0 +1,60 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/common/rate"
+	"github.com/perfect-panel/ppanel-node/conf"
+)
+
+func TestSchedulesRerateBuckets(t *testing.T) {
+	Init()
+	SetNodeSchedules(nil)
+	users := []panel.UserInfo{
+		{Id: 1, Uuid: "peak", SpeedLimit: 16, Group: "basic"},
+		{Id: 2, Uuid: "premium", SpeedLimit: 16, Group: "premium"},
+	}
+	l := AddLimiter("tag", users, map[int]int{})
+	now := time.Now()
+	schedules, err := NewSchedules([]conf.SpeedSchedule{{
+		Start:   now.Add(-time.Hour).Format("15:04"),
+		End:     now.Add(time.Hour).Format("15:04"),
+		Groups:  []string{"basic"},
+		Percent: 50,
+	}})
+	if err != nil {
+		t.Fatalf("NewSchedules() error: %v", err)
+	}
+
+	_, down, _ := l.CheckLimit(format.UserTag("tag", "peak"), "127.0.0.1", true, true)
+	bucket := down.(*rate.Bucket)
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v before the schedule, want 2000000 B/s", got)
+	}
+	l.SetSchedules(schedules)
+	if users := l.ApplySchedules(now); users != 1 {
+		t.Fatalf("ApplySchedules() = %v, want the bucket re-rated", users)
+	}
+	if got := bucket.Rate(); got != 1000000 {
+		t.Fatalf("rate = %v in the schedule, want half of the limit", got)
+	}
+	if users := l.ApplySchedules(now); users != -1 {
+		t.Fatalf("ApplySchedules() = %v, want no change", users)
+	}
+	_, down, _ = l.CheckLimit(format.UserTag("tag", "premium"), "127.0.0.1", true, true)
+	if got := down.(*rate.Bucket).Rate(); got != 2000000 {
+		t.Fatalf("rate = %v for another group, want the user limit", got)
+	}
+
+	l.ApplySchedules(now.Add(2 * time.Hour))
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v after the schedule, want the user limit", got)
+	}
+
+	if _, err := NewSchedules([]conf.SpeedSchedule{{Start: "20:00", End: "20:00", Percent: 50}}); err == nil {
+		t.Fatal("NewSchedules() accepted an empty schedule")
+	}
+}
@@ -0,0 +1,151 @@
+package node
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/limiter"
+)
+
+var (
+	ErrInboundNotFound = errors.New("inbound not found")
+	ErrUserNotFound    = errors.New("user not found")
+)
+
+type InboundStatus struct {
+	Tag   string `json:"tag"`
+	Type  string `json:"type"`
+	Users int    `json:"users"`
+	Links int    `json:"links"`
+}
+
+type UserStatus struct {
+	UID               int      `json:"uid"`
+	SpeedLimit        int      `json:"speed_limit"`
+	UpSpeedLimit      int      `json:"up_speed_limit"`
+	DownSpeedLimit    int      `json:"down_speed_limit"`
+	DeviceLimit       int      `json:"device_limit"`
+	ConnLimit         int      `json:"conn_limit"`
+	Burst             int      `json:"burst"`
+	FullSpeed         int      `json:"full_speed"`
+	DynamicSpeedLimit int      `json:"dynamic_speed_limit"`
+	ExpireTime        int64    `json:"expire_time"`
+	OnlineIPs         []string `json:"online_ips"`
+	Links             int      `json:"links"`
+}
+
+// Inbounds returns the running inbounds.
+func (n *Node) Inbounds() []InboundStatus {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	inbounds := make([]InboundStatus, 0, len(n.controllers))
+	for _, c := range n.controllers {
+		if c.tag == "" || c.limiter == nil {
+			continue
+		}
+		users := 0
+		c.limiter.UserLimitInfo.Range(func(_, _ interface{}) bool {
+			users++
+			return true
+		})
+		inbounds = append(inbounds, InboundStatus{
+			Tag:   c.tag,
+			Type:  c.info.Type,
+			Users: users,
+			Links: c.server.ActiveLinks(c.tag),
+		})
+	}
+	return inbounds
+}
+
+// Users returns the users of the inbound tag, sorted by UID.
+func (n *Node) Users(tag string) ([]UserStatus, error) {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	c := n.controller(tag)
+	if c == nil {
+		return nil, ErrInboundNotFound
+	}
+	links := c.server.UserLinks(tag)
+	users := make([]UserStatus, 0)
+	c.limiter.UserLimitInfo.Range(func(key, value interface{}) bool {
+		u := value.(*limiter.UserLimitInfo)
+		users = append(users, UserStatus{
+			UID:               u.UID,
+			SpeedLimit:        u.SpeedLimit,
+			UpSpeedLimit:      u.UpSpeedLimit,
+			DownSpeedLimit:    u.DownSpeedLimit,
+			DeviceLimit:       u.DeviceLimit,
+			ConnLimit:         u.ConnLimit,
+			Burst:             u.Burst,
+			FullSpeed:         u.FullSpeed,
+			DynamicSpeedLimit: u.DynamicSpeedLimit,
+			ExpireTime:        u.ExpireTime,
+			OnlineIPs:         c.limiter.UserOnlineIPs(key.(string)),
+			Links:             links[u.UID],
+		})
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UID < users[j].UID
+	})
+	return users, nil
+}
+
+// KickUser closes all links of the user and returns how many were open.
+func (n *Node) KickUser(tag string, uid int) (int, error) {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	c := n.controller(tag)
+	if c == nil {
+		return 0, ErrInboundNotFound
+	}
+	taguuid, ok := c.userTag(uid)
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return c.server.CloseUserLinks(taguuid), nil
+}
+
+// LimitUser caps the user at limit Mbps for d, a zero limit removes the cap.
+func (n *Node) LimitUser(tag string, uid int, limit int, d time.Duration) error {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	c := n.controller(tag)
+	if c == nil {
+		return ErrInboundNotFound
+	}
+	taguuid, ok := c.userTag(uid)
+	if !ok {
+		return ErrUserNotFound
+	}
+	if err := c.limiter.SetDynamicSpeedLimit(taguuid, limit, time.Now().Add(d)); err != nil {
+		return err
+	}
+	c.reconnectUsers()
+	return nil
+}
+
+// controller returns the running controller of tag, n.access must be held.
+func (n *Node) controller(tag string) *Controller {
+	for _, c := range n.controllers {
+		if c.tag == tag && c.limiter != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// userTag returns the limiter key of the user uid.
+func (c *Controller) userTag(uid int) (string, bool) {
+	var taguuid string
+	c.limiter.UserLimitInfo.Range(func(key, value interface{}) bool {
+		if value.(*limiter.UserLimitInfo).UID == uid {
+			taguuid = key.(string)
+			return false
+		}
+		return true
+	})
+	return taguuid, taguuid != ""
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/perfect-panel/ppanel-node/common/file"
+	"github.com/perfect-panel/ppanel-node/common/task"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,12 +23,12 @@ func (c *Controller) renewCertTask(_ context.Context) error {
 	l, err := NewLego(c.info)
 	if err != nil {
 		log.WithField("节点", c.tag).Info("new lego error: ", err)
-		return nil
+		return task.ErrFailed
 	}
 	err = l.RenewCert()
 	if err != nil {
 		log.WithField("节点", c.tag).Info("renew cert error: ", err)
-		return nil
+		return task.ErrFailed
 	}
 	return nil
 }
@@ -4,34 +4,51 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/metrics"
 	"github.com/perfect-panel/ppanel-node/common/task"
+	"github.com/perfect-panel/ppanel-node/conf"
 	vCore "github.com/perfect-panel/ppanel-node/core"
 	"github.com/perfect-panel/ppanel-node/limiter"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 type Controller struct {
 	server                  *vCore.XrayCore
-	apiClient               *panel.ClientV1
+	apiClient               panel.NodeClient
 	tag                     string
 	limiter                 *limiter.Limiter
 	userList                []panel.UserInfo
 	aliveMap                map[int]int
+	aliveUpdated            time.Time
 	info                    *panel.NodeInfo
+	pendingTraffic          *trafficBuffer
+	rules                   *limiter.RuleEngine
+	throttleEvents          []panel.ThrottleEvent
+	journal                 *trafficJournal
 	userListMonitorPeriodic *task.Task
+	aliveListPeriodic       *task.Task
 	userReportPeriodic      *task.Task
 	renewCertPeriodic       *task.Task
 	onlineIpReportPeriodic  *task.Task
+	journalPeriodic         *task.Task
+	quotaPeriodic           *task.Task
+	dynamicLimitPeriodic    *task.Task
+	schedulePeriodic        *task.Task
+	devicePeriodic          *task.Task
+	inboundRemoved          bool
 }
 
 // NewController return a Node controller with default parameters.
-func NewController(core *vCore.XrayCore, api *panel.ClientV1, info *panel.NodeInfo) *Controller {
+func NewController(core *vCore.XrayCore, api panel.NodeClient, info *panel.NodeInfo) *Controller {
 	controller := &Controller{
-		server:    core,
-		apiClient: api,
-		info:      info,
+		server:         core,
+		apiClient:      api,
+		info:           info,
+		pendingTraffic: newTrafficBuffer(),
 	}
 	return controller
 }
@@ -42,20 +59,72 @@ func (c *Controller) Start() error {
 	// Update user
 	c.userList, err = c.apiClient.GetUserList(context.Background())
 	if err != nil {
-		return fmt.Errorf("get user list error: %s", err)
+		// Keep serving the last known users while the panel is unreachable
+		userList, cerr := c.apiClient.GetCachedUserList()
+		if cerr != nil {
+			return fmt.Errorf("get user list error: %s", err)
+		}
+		log.WithFields(log.Fields{
+			"type": c.info.Type,
+			"id":   c.info.Id,
+			"err":  err,
+		}).Warn("获取用户列表失败，使用本地缓存")
+		c.userList = userList
 	}
 	if len(c.userList) == 0 {
 		return errors.New("add users error: not have any user")
 	}
-	c.aliveMap, err = c.apiClient.GetUserAlive()
-	if err != nil {
-		return fmt.Errorf("failed to get user alive list: %s", err)
+	c.aliveMap = make(map[int]int)
+	if c.aliveInterval() > 0 {
+		if aliveMap, err := c.apiClient.GetUserAlive(context.Background()); err != nil {
+			// Device limits only count this node until the next refresh
+			log.WithFields(log.Fields{
+				"type": c.info.Type,
+				"id":   c.info.Id,
+				"err":  err,
+			}).Warn("获取在线设备列表失败")
+		} else {
+			c.aliveMap = aliveMap
+			c.aliveUpdated = time.Now()
+		}
 	}
 	c.tag = c.buildNodeTag(c.info)
+	c.journal = newTrafficJournal(c.server.Config.DataDir, c.info)
+	c.replayTrafficJournal()
+
+	if rules := c.server.Config.LimitConfig.DynamicRules; len(rules) > 0 {
+		c.rules, err = limiter.NewRuleEngine(rules)
+		if err != nil {
+			return fmt.Errorf("dynamic rule error: %s", err)
+		}
+	}
+	switch policy := c.server.Config.LimitConfig.DevicePolicy; policy {
+	case "", "reject", "evict":
+	default:
+		return fmt.Errorf("unknown device policy %q", policy)
+	}
+	schedules, err := limiter.NewSchedules(speedSchedules(c.info.Protocol))
+	if err != nil {
+		return fmt.Errorf("speed schedule error: %s", err)
+	}
 
 	// add limiter
 	l := limiter.AddLimiter(c.tag, c.userList, c.aliveMap)
+	l.QuotaSpeedLimit = c.server.Config.LimitConfig.QuotaSpeedLimit
+	l.ConnLimit = c.server.Config.LimitConfig.ConnLimit
+	l.IPConnLimit = c.server.Config.LimitConfig.IPConnLimit
+	l.Burst = c.server.Config.LimitConfig.Burst
+	l.RefillInterval = c.server.Config.LimitConfig.RefillInterval
+	l.FullSpeed = c.server.Config.LimitConfig.FullSpeed
+	l.DeviceEvict = c.server.Config.LimitConfig.DevicePolicy == "evict"
+	l.DeviceGrace = c.server.Config.LimitConfig.DeviceGrace
+	l.DeviceIPv4Prefix = c.server.Config.LimitConfig.DeviceIPv4Prefix
+	l.DeviceIPv6Prefix = c.server.Config.LimitConfig.DeviceIPv6Prefix
+	l.SetInboundSpeedLimit(c.info.Protocol.SpeedLimit, c.info.Protocol.UpSpeedLimit, c.info.Protocol.DownSpeedLimit)
+	l.SetSchedules(schedules)
+	l.ApplySchedules(time.Now())
 	c.limiter = l
+	c.updateQuota(c.userList)
 
 	if c.info.Protocol.Security == "tls" {
 		err = c.requestCert()
@@ -83,26 +152,184 @@ func (c *Controller) Start() error {
 
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	if c.tag == "" {
+		// never started
+		return nil
+	}
 	limiter.DeleteLimiter(c.tag)
+	c.stopTasks()
+	metrics.TaskLastSuccess.DeletePartialMatch(prometheus.Labels{"tag": c.tag})
+	metrics.LinksRejected.DeletePartialMatch(prometheus.Labels{"tag": c.tag})
+	if c.journal != nil {
+		// Keep the traffic counted since the last push for the next start
+		userTraffic, _ := c.server.GetUserTrafficSlice(c.tag, 0)
+		c.pendingTraffic.Merge(userTraffic)
+		_ = c.flushTrafficJournal(context.Background())
+	}
+	if c.inboundRemoved {
+		return nil
+	}
+	err := c.server.DelNode(c.tag)
+	if err != nil {
+		return fmt.Errorf("del node error: %s", err)
+	}
+	c.inboundRemoved = true
+	return nil
+}
+
+// update applies a changed node info to the running controller. The inbound
+// is only rebuilt when the protocol settings changed and the tasks are only
+// restarted when their intervals changed.
+func (c *Controller) update(info *panel.NodeInfo) error {
+	schedules, err := limiter.NewSchedules(speedSchedules(info.Protocol))
+	if err != nil {
+		return fmt.Errorf("speed schedule error: %s", err)
+	}
+	old, protocol := *c.info.Protocol, *info.Protocol
+	// The speed limits are applied to the running inbound
+	old.SpeedLimit, old.UpSpeedLimit, old.DownSpeedLimit = 0, 0, 0
+	protocol.SpeedLimit, protocol.UpSpeedLimit, protocol.DownSpeedLimit = 0, 0, 0
+	old.SpeedSchedules, protocol.SpeedSchedules = nil, nil
+	protocolChanged := old != protocol
+	tasksChanged := protocolChanged ||
+		c.info.PushInterval != info.PushInterval ||
+		c.info.PullInterval != info.PullInterval
+	c.info = info
+	c.limiter.SetInboundSpeedLimit(info.Protocol.SpeedLimit, info.Protocol.UpSpeedLimit, info.Protocol.DownSpeedLimit)
+	c.limiter.SetSchedules(schedules)
+	c.limiter.ApplySchedules(time.Now())
+	if protocolChanged {
+		if err := c.rebuildInbound(); err != nil {
+			return err
+		}
+		log.WithField("节点", c.tag).Info("节点协议配置已更新")
+	}
+	if tasksChanged {
+		c.reloadTask()
+	}
+	return nil
+}
+
+// speedSchedules returns the speed schedules of the inbound sent by the panel.
+func speedSchedules(protocol *panel.Protocol) []conf.SpeedSchedule {
+	if protocol.SpeedSchedules == nil {
+		return nil
+	}
+	schedules := make([]conf.SpeedSchedule, 0, len(*protocol.SpeedSchedules))
+	for _, s := range *protocol.SpeedSchedules {
+		schedules = append(schedules, conf.SpeedSchedule{
+			Start:           s.Start,
+			End:             s.End,
+			Groups:          s.Groups,
+			Percent:         s.Percent,
+			SpeedLimit:      s.SpeedLimit,
+			TotalSpeedLimit: s.TotalSpeedLimit,
+		})
+	}
+	return schedules
+}
+
+// rebuildInbound replaces the inbound with one built from the current node
+// info and adds the current users to it.
+func (c *Controller) rebuildInbound() error {
+	if c.info.Protocol.Security == "tls" {
+		if err := c.requestCert(); err != nil {
+			return fmt.Errorf("request cert error: %s", err)
+		}
+	}
+	if err := c.stopAccepting(); err != nil {
+		return err
+	}
+	if err := c.server.AddNode(c.tag, c.info); err != nil {
+		return fmt.Errorf("add new node error: %s", err)
+	}
+	c.inboundRemoved = false
+	_, err := c.server.AddUsers(&vCore.AddUsersParams{
+		Tag:      c.tag,
+		Users:    c.userList,
+		NodeInfo: c.info,
+	})
+	if err != nil {
+		return fmt.Errorf("add users error: %s", err)
+	}
+	return nil
+}
+
+func (c *Controller) stopTasks() {
 	if c.userListMonitorPeriodic != nil {
 		c.userListMonitorPeriodic.Close()
+		c.userListMonitorPeriodic = nil
+	}
+	if c.aliveListPeriodic != nil {
+		c.aliveListPeriodic.Close()
+		c.aliveListPeriodic = nil
 	}
 	if c.userReportPeriodic != nil {
 		c.userReportPeriodic.Close()
+		c.userReportPeriodic = nil
 	}
 	if c.renewCertPeriodic != nil {
 		c.renewCertPeriodic.Close()
+		c.renewCertPeriodic = nil
 	}
 	if c.onlineIpReportPeriodic != nil {
 		c.onlineIpReportPeriodic.Close()
+		c.onlineIpReportPeriodic = nil
 	}
-	err := c.server.DelNode(c.tag)
-	if err != nil {
+	if c.journalPeriodic != nil {
+		c.journalPeriodic.Close()
+		c.journalPeriodic = nil
+	}
+	if c.quotaPeriodic != nil {
+		c.quotaPeriodic.Close()
+		c.quotaPeriodic = nil
+	}
+	if c.dynamicLimitPeriodic != nil {
+		c.dynamicLimitPeriodic.Close()
+		c.dynamicLimitPeriodic = nil
+	}
+	if c.devicePeriodic != nil {
+		c.devicePeriodic.Close()
+		c.devicePeriodic = nil
+	}
+	if c.schedulePeriodic != nil {
+		c.schedulePeriodic.Close()
+		c.schedulePeriodic = nil
+	}
+}
+
+// stopAccepting removes the inbound, so no new connections are accepted.
+// Connections that are already established are kept until they finish.
+func (c *Controller) stopAccepting() error {
+	if c.inboundRemoved {
+		return nil
+	}
+	if err := c.server.DelNode(c.tag); err != nil {
 		return fmt.Errorf("del node error: %s", err)
 	}
+	c.inboundRemoved = true
 	return nil
 }
 
+// drain waits until all user links of the node are closed or the deadline
+// is reached, in which case the remaining links are closed.
+func (c *Controller) drain(deadline time.Time) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		links := c.server.ActiveLinks(c.tag)
+		if links == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.WithField("节点", c.tag).Warnf("等待超时，强制关闭 %d 个连接", links)
+			c.server.CloseLinks(c.tag)
+			return
+		}
+		<-ticker.C
+	}
+}
+
 func (c *Controller) buildNodeTag(node *panel.NodeInfo) string {
-	return fmt.Sprintf("[%s]-%s:%d", c.apiClient.APIHost, node.Type, node.Id)
+	return fmt.Sprintf("[%s]-%s:%d", c.server.Config.ApiConfig.ApiHost, node.Type, node.Id)
 }
@@ -0,0 +1,577 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/api/panel/paneltest"
+	"github.com/perfect-panel/ppanel-node/common/format"
+	"github.com/perfect-panel/ppanel-node/common/metrics"
+	"github.com/perfect-panel/ppanel-node/conf"
+	vCore "github.com/perfect-panel/ppanel-node/core"
+	"github.com/perfect-panel/ppanel-node/limiter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+	coreConf "github.com/xtls/xray-core/infra/conf"
+)
+
+// e2eProtocol is a protocol served by the node under test and the outbound
+// of a client connecting to it with the password or id of the user.
+type e2eProtocol struct {
+	protocol panel.Protocol
+	user     panel.UserInfo
+	outbound func(port int, password string) string
+}
+
+var e2eProtocols = []e2eProtocol{
+	{
+		protocol: panel.Protocol{Type: "vless", Transport: "tcp", Enable: true},
+		user:     panel.UserInfo{Id: 1, Uuid: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+		outbound: func(port int, password string) string {
+			return fmt.Sprintf(`{"protocol":"vless","settings":{"vnext":[{"address":"127.0.0.1","port":%d,
+				"users":[{"id":%q,"encryption":"none"}]}]}}`, port, password)
+		},
+	},
+	{
+		protocol: panel.Protocol{Type: "trojan", Transport: "tcp", Enable: true},
+		user:     panel.UserInfo{Id: 2, Uuid: "0d6f1a4e-5f0c-4b8e-9a47-36c5d2a3f7b1"},
+		outbound: func(port int, password string) string {
+			return fmt.Sprintf(`{"protocol":"trojan","settings":{"servers":[{"address":"127.0.0.1","port":%d,
+				"password":%q}]}}`, port, password)
+		},
+	},
+	{
+		protocol: panel.Protocol{Type: "shadowsocks", Cipher: "aes-128-gcm", Enable: true},
+		user:     panel.UserInfo{Id: 3, Uuid: "6a1e7c2b-93f4-4d0e-8b5a-1f2c3d4e5f60"},
+		outbound: func(port int, password string) string {
+			return fmt.Sprintf(`{"protocol":"shadowsocks","settings":{"servers":[{"address":"127.0.0.1","port":%d,
+				"method":"aes-128-gcm","password":%q}]}}`, port, password)
+		},
+	},
+}
+
+// testNode is a node started against the fake panel, with an echo server to
+// proxy to.
+type testNode struct {
+	*Node
+	fake      *paneltest.Server
+	config    *conf.Conf
+	provider  *panel.Panel
+	xcore     *vCore.XrayCore
+	protocols []e2eProtocol
+	ports     []int // of the protocols
+	echo      int
+}
+
+type testNodeOptions struct {
+	// protocols served by the node, the first of e2eProtocols when empty
+	protocols []e2eProtocol
+	// configure changes the config of the node
+	configure func(c *conf.Conf)
+	// beforeStart runs before the server config is fetched
+	beforeStart func(n *testNode)
+}
+
+// newTestNode starts a node serving the protocols of opts from the fake
+// panel, each with its user. It is closed when the test ends.
+func newTestNode(t *testing.T, opts testNodeOptions) *testNode {
+	t.Helper()
+	limiter.Init()
+	n := &testNode{
+		protocols: opts.protocols,
+		echo:      startEchoServer(t),
+	}
+	if len(n.protocols) == 0 {
+		n.protocols = e2eProtocols[:1]
+	}
+	protocols := make([]panel.Protocol, len(n.protocols))
+	for i, p := range n.protocols {
+		protocols[i] = p.protocol
+		protocols[i].Port = freePort(t)
+		n.ports = append(n.ports, protocols[i].Port)
+	}
+	n.fake = paneltest.NewServer(1, "secret", &panel.Data{
+		PushInterval: 60,
+		PullInterval: 60,
+		IPStrategy:   "prefer_ipv4",
+		Protocols:    &protocols,
+		Total:        len(protocols),
+	})
+	t.Cleanup(n.fake.Close)
+	for i := range n.protocols {
+		n.setUser(i, n.protocols[i].user)
+	}
+
+	n.config = conf.New()
+	n.config.ApiConfig = n.fake.ApiConfig()
+	n.config.DataDir = t.TempDir()
+	if opts.configure != nil {
+		opts.configure(n.config)
+	}
+	n.provider = panel.New(&n.config.ApiConfig, filepath.Join(n.config.DataDir, "cache"))
+	if opts.beforeStart != nil {
+		opts.beforeStart(n)
+	}
+	serverconfig, err := n.provider.GetServerConfig(context.Background())
+	if err != nil {
+		t.Fatalf("GetServerConfig() error: %v", err)
+	}
+	n.xcore = vCore.New(n.config, n.provider)
+	if err := n.xcore.Start(serverconfig); err != nil {
+		t.Fatalf("XrayCore.Start() error: %v", err)
+	}
+	t.Cleanup(func() { _ = n.xcore.Close() })
+	n.Node, err = New(n.xcore, n.config, serverconfig)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if err := n.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	t.Cleanup(func() { _ = n.Close() })
+	return n
+}
+
+// client starts a client connecting to protocol i as its user.
+func (n *testNode) client(t *testing.T, i int) *core.Instance {
+	t.Helper()
+	return startClient(t, n.protocols[i].outbound(n.ports[i], n.protocols[i].user.Uuid))
+}
+
+// setUser replaces the users of protocol i on the fake panel with user.
+func (n *testNode) setUser(i int, user panel.UserInfo) {
+	n.fake.SetUsers(n.protocols[i].protocol.Type, []panel.UserInfo{user})
+}
+
+// pushTraffic reports the traffic of protocol i until the fake panel got
+// upload and download of its user, and returns what it got.
+func (n *testNode) pushTraffic(t *testing.T, i int) panel.UserTraffic {
+	t.Helper()
+	p := n.protocols[i]
+	deadline := time.Now().Add(5 * time.Second)
+	var traffic panel.UserTraffic
+	for time.Now().Before(deadline) {
+		if err := n.controllers[i].reportUserTrafficTask(context.Background()); err != nil {
+			t.Fatalf("reportUserTrafficTask() error: %v", err)
+		}
+		traffic = n.fake.Traffic(p.protocol.Type)[p.user.Id]
+		if traffic.Upload > 0 && traffic.Download > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return traffic
+}
+
+// TestEndToEnd runs the node against the fake panel and proxies real
+// connections through each inbound to a local echo server.
+func TestEndToEnd(t *testing.T) {
+	n := newTestNode(t, testNodeOptions{protocols: e2eProtocols})
+
+	// The config is only sent again once it changed
+	if got, err := n.provider.GetServerConfig(context.Background()); got != nil || err != nil {
+		t.Fatalf("GetServerConfig() = %v, %v, want not modified", got, err)
+	}
+	if got := n.fake.Requests("/v2/server/1"); got != 1 {
+		t.Fatalf("server config fetched %d times, want 1", got)
+	}
+	if err := n.controllers[0].userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	if got := n.fake.Requests("/v1/server/user"); got != len(e2eProtocols) {
+		t.Fatalf("user list fetched %d times, want %d", got, len(e2eProtocols))
+	}
+
+	for i, p := range e2eProtocols {
+		t.Run(p.protocol.Type, func(t *testing.T) {
+			proxyEcho(t, n.client(t, i), n.echo)
+
+			if traffic := n.pushTraffic(t, i); traffic.Upload == 0 || traffic.Download == 0 {
+				t.Fatalf("pushed traffic = %+v, want upload and download", traffic)
+			}
+			online := n.fake.OnlineUsers(p.protocol.Type)
+			if len(online) != 1 || online[0].UID != p.user.Id {
+				t.Fatalf("pushed online users = %+v, want user %d", online, p.user.Id)
+			}
+			if n.fake.Status(p.protocol.Type) == nil {
+				t.Fatal("node status not pushed")
+			}
+		})
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*stdnet.TCPAddr).Port
+}
+
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*stdnet.TCPAddr).Port
+}
+
+// startClient starts an Xray instance proxying through outbound.
+func startClient(t *testing.T, outbound string) *core.Instance {
+	t.Helper()
+	config := &coreConf.Config{}
+	if err := json.Unmarshal([]byte(`{"outbounds":[`+outbound+`]}`), config); err != nil {
+		t.Fatalf("decode client config error: %v", err)
+	}
+	pbConfig, err := config.Build()
+	if err != nil {
+		t.Fatalf("build client config error: %v", err)
+	}
+	client, err := core.New(pbConfig)
+	if err != nil {
+		t.Fatalf("create client error: %v", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("start client error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func proxyEcho(t *testing.T, client *core.Instance, port int) {
+	t.Helper()
+	if err := echoThrough(client, port); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoThrough sends a payload to the echo server on port through client
+// and checks it comes back.
+func echoThrough(client *core.Instance, port int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := core.Dial(ctx, client, net.TCPDestination(net.LocalHostIP, net.Port(port)))
+	if err != nil {
+		return fmt.Errorf("dial through proxy error: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := bytes.Repeat([]byte("ping"), 1024)
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("write through proxy error: %w", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("read through proxy error: %w", err)
+	}
+	if !bytes.Equal(got, payload) {
+		return errors.New("echo through proxy differs from the payload")
+	}
+	return nil
+}
+
+// openLink opens a connection to the echo server on port through client
+// and keeps it open until it is closed.
+func openLink(client *core.Instance, port int) (stdnet.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := core.Dial(ctx, client, net.TCPDestination(net.LocalHostIP, net.Port(port)))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("dial through proxy error: %w", err)
+	}
+	link := &cancelConn{Conn: conn, cancel: cancel}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		link.Close()
+		return nil, fmt.Errorf("write through proxy error: %w", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		link.Close()
+		return nil, fmt.Errorf("read through proxy error: %w", err)
+	}
+	return link, nil
+}
+
+// cancelConn cancels the context of the dial when closed.
+type cancelConn struct {
+	stdnet.Conn
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) Close() error {
+	defer c.cancel()
+	return c.Conn.Close()
+}
+
+func TestAliveList(t *testing.T) {
+	// Panels without the alive list do not keep the node from starting
+	n := newTestNode(t, testNodeOptions{})
+	ctrl := n.controllers[0]
+	uid := n.protocols[0].user.Id
+
+	n.fake.SetAlive(map[int]int{uid: 2})
+	if err := ctrl.aliveListMonitor(context.Background()); err != nil {
+		t.Fatalf("aliveListMonitor() error: %v", err)
+	}
+	if got := ctrl.limiter.AliveIP(uid); got != 2 {
+		t.Fatalf("alive IPs = %d, want 2", got)
+	}
+
+	n.fake.SetAlive(nil)
+	if err := ctrl.aliveListMonitor(context.Background()); err != nil {
+		t.Fatalf("aliveListMonitor() error: %v", err)
+	}
+	if got := ctrl.limiter.AliveIP(uid); got != 0 {
+		t.Fatalf("alive IPs = %d after a 404, want 0", got)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	p := e2eProtocols[0]
+	p.user.Quota = 1 << 20
+	p.user.Used = p.user.Quota - 1024
+	n := newTestNode(t, testNodeOptions{protocols: []e2eProtocol{p}})
+	ctrl := n.controllers[0]
+	client := n.client(t, 0)
+
+	// The last KiB of the quota is used up by the first connection
+	proxyEcho(t, client, n.echo)
+	if err := ctrl.quotaMonitor(context.Background()); err != nil {
+		t.Fatalf("quotaMonitor() error: %v", err)
+	}
+	if err := echoThrough(client, n.echo); err == nil {
+		t.Fatal("user over the quota still connects")
+	}
+
+	// A new month on the panel lets the user in again
+	p.user.Used = 0
+	n.setUser(0, p.user)
+	if err := ctrl.userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	if err := ctrl.quotaMonitor(context.Background()); err != nil {
+		t.Fatalf("quotaMonitor() error: %v", err)
+	}
+	proxyEcho(t, client, n.echo)
+}
+
+// TestTrafficJournalReplay restarts a node which crashed after the panel
+// accepted a batch but before it was removed from the journal.
+func TestTrafficJournalReplay(t *testing.T) {
+	var journal string
+	n := newTestNode(t, testNodeOptions{
+		beforeStart: func(n *testNode) {
+			api, err := n.provider.NodeClient("vless")
+			if err != nil {
+				t.Fatalf("NodeClient() error: %v", err)
+			}
+			batch := []panel.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+			ctx := panel.WithIdempotencyKey(context.Background(), "batch-1")
+			if err := api.ReportUserTraffic(ctx, &batch); err != nil {
+				t.Fatalf("ReportUserTraffic() error: %v", err)
+			}
+			journal = filepath.Join(n.config.DataDir, "traffic-vless1.json")
+			data := `{"batch":{"key":"batch-1","traffic":[{"uid":1,"upload":100,"download":200}]},
+				"traffic":[{"uid":1,"upload":5,"download":5}]}`
+			if err := os.WriteFile(journal, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+	})
+
+	// The batch is pushed again with its key and counted once
+	if err := n.controllers[0].reportUserTrafficTask(context.Background()); err != nil {
+		t.Fatalf("reportUserTrafficTask() error: %v", err)
+	}
+	want := panel.UserTraffic{UID: 1, Upload: 105, Download: 205}
+	if got := n.fake.Traffic("vless")[1]; got != want {
+		t.Fatalf("pushed traffic = %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(journal); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("journal left after the push: %v", err)
+	}
+}
+
+func TestDynamicLimit(t *testing.T) {
+	// Links of a limited user have buckets the cap applies to
+	p := e2eProtocols[0]
+	p.user.SpeedLimit = 16
+	n := newTestNode(t, testNodeOptions{
+		protocols: []e2eProtocol{p},
+		configure: func(c *conf.Conf) {
+			c.LimitConfig.DynamicRules = []conf.DynamicRule{
+				{Connections: 1, SpeedLimit: 1, Duration: time.Minute},
+			}
+			c.LimitConfig.ReportThrottle = true
+		},
+	})
+	ctrl := n.controllers[0]
+	client := n.client(t, 0)
+
+	if err := ctrl.dynamicLimitMonitor(context.Background()); err != nil {
+		t.Fatalf("dynamicLimitMonitor() error: %v", err)
+	}
+	// Two open links break the rule
+	for range 2 {
+		conn, err := openLink(client, n.echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := ctrl.dynamicLimitMonitor(context.Background()); err != nil {
+		t.Fatalf("dynamicLimitMonitor() error: %v", err)
+	}
+
+	events := n.fake.Throttles("vless")
+	if len(events) != 1 || events[0].UID != p.user.Id || events[0].Connections != 2 || events[0].SpeedLimit != 1 {
+		t.Fatalf("pushed throttle events = %+v, want user %d capped at 1 Mbps", events, p.user.Id)
+	}
+	taguuid := format.UserTag(ctrl.tag, p.user.Uuid)
+	v, _ := ctrl.limiter.UserLimitInfo.Load(taguuid)
+	if got := v.(*limiter.UserLimitInfo).DynamicSpeedLimit; got != 1 {
+		t.Fatalf("DynamicSpeedLimit = %d, want 1", got)
+	}
+	// The open links are kept and slowed down to the cap
+	if got := n.xcore.ActiveLinks(ctrl.tag); got != 2 {
+		t.Fatalf("ActiveLinks() = %d after the cap, want 2", got)
+	}
+	b, _ := ctrl.limiter.SpeedLimiter.Load(taguuid)
+	if got := b.(*limiter.Buckets).Down.Rate(); got != 125000 {
+		t.Fatalf("rate = %v after the cap, want 125000 B/s", got)
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	p := e2eProtocols[0]
+	p.user.ConnLimit = 1
+	n := newTestNode(t, testNodeOptions{protocols: []e2eProtocol{p}})
+	tag := n.controllers[0].tag
+	client := n.client(t, 0)
+
+	conn, err := openLink(client, n.echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLink(client, n.echo); err == nil {
+		t.Fatal("second connection accepted over the limit of 1")
+	}
+	if got := testutil.ToFloat64(metrics.LinksRejected.WithLabelValues(tag, "conn_limit")); got != 1 {
+		t.Fatalf("rejected links = %v, want 1", got)
+	}
+
+	// The slot is free again once the first connection is closed
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.xcore.ActiveLinks(tag) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	proxyEcho(t, client, n.echo)
+}
+
+func TestLiveSpeedLimit(t *testing.T) {
+	n := newTestNode(t, testNodeOptions{})
+	ctrl := n.controllers[0]
+	user := n.protocols[0].user
+	taguuid := format.UserTag(ctrl.tag, user.Uuid)
+	client := n.client(t, 0)
+
+	// The link of the unlimited user has no bucket, it is closed when the
+	// user gets a limit
+	conn, err := openLink(client, n.echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctrl.limiter.SpeedLimiter.Load(taguuid); ok {
+		t.Fatal("bucket for the unlimited user")
+	}
+	user.SpeedLimit = 8
+	n.setUser(0, user)
+	if err := ctrl.userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	if links := n.xcore.ActiveLinks(ctrl.tag); links != 0 {
+		t.Fatalf("ActiveLinks() = %d, want the unlimited link closed", links)
+	}
+	conn.Close()
+
+	// A new link gets a bucket, which follows a raised limit
+	conn, err = openLink(client, n.echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	v, ok := ctrl.limiter.SpeedLimiter.Load(taguuid)
+	if !ok {
+		t.Fatal("no bucket for the limited user")
+	}
+	bucket := v.(*limiter.Buckets).Down
+	if got := bucket.Rate(); got != 1000000 {
+		t.Fatalf("rate = %v, want 1000000 B/s", got)
+	}
+	user.SpeedLimit = 16
+	n.setUser(0, user)
+	if err := ctrl.userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	if got := bucket.Rate(); got != 2000000 {
+		t.Fatalf("rate = %v after the change, want 2000000 B/s", got)
+	}
+	// The link is kept and still works
+	if links := n.xcore.ActiveLinks(ctrl.tag); links != 1 {
+		t.Fatalf("ActiveLinks() = %d, want the link kept", links)
+	}
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("write on the kept link error: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("read on the kept link error: %v", err)
+	}
+}
+
+func TestDeletedUserTraffic(t *testing.T) {
+	n := newTestNode(t, testNodeOptions{})
+	ctrl := n.controllers[0]
+	proxyEcho(t, n.client(t, 0), n.echo)
+
+	// The traffic counted before the user was replaced is still pushed
+	n.setUser(0, e2eProtocols[1].user)
+	if err := ctrl.userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	if err := ctrl.reportUserTrafficTask(context.Background()); err != nil {
+		t.Fatalf("reportUserTrafficTask() error: %v", err)
+	}
+	traffic := n.fake.Traffic("vless")[n.protocols[0].user.Id]
+	if traffic.Upload < 4096 || traffic.Download < 4096 {
+		t.Fatalf("pushed traffic = %+v, want the traffic of the deleted user", traffic)
+	}
+}
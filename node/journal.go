@@ -0,0 +1,95 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+)
+
+// trafficJournal is a small write-ahead journal of per-UID traffic deltas
+// which have not been accepted by the panel yet. It lets counted traffic
+// survive crashes, restarts and reloads.
+type trafficJournal struct {
+	path   string
+	access sync.Mutex
+}
+
+// trafficJournalFile is the batch being pushed, with its idempotency key,
+// and the traffic not pushed yet.
+type trafficJournalFile struct {
+	Batch   *trafficBatch       `json:"batch,omitempty"`
+	Traffic []panel.UserTraffic `json:"traffic"`
+}
+
+func newTrafficJournal(dir string, info *panel.NodeInfo) *trafficJournal {
+	return &trafficJournal{
+		path: filepath.Join(dir, fmt.Sprintf("traffic-%s%d.json", info.Type, info.Id)),
+	}
+}
+
+// Load returns the traffic recorded in the journal, empty when there is
+// none.
+func (j *trafficJournal) Load() (*trafficJournalFile, error) {
+	f := &trafficJournalFile{}
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("read traffic journal error: %s", err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("unmarshal traffic journal error: %s", err)
+	}
+	return f, nil
+}
+
+// Update replaces the journal with the traffic returned by snapshot. The
+// snapshot is taken under the journal lock, so concurrent updates are written
+// in the same order their snapshots were taken.
+func (j *trafficJournal) Update(snapshot func() *trafficJournalFile) error {
+	j.access.Lock()
+	defer j.access.Unlock()
+	return j.save(snapshot())
+}
+
+// save writes the journal to a temporary path first and renames it,
+// so a crash never leaves a torn journal.
+func (j *trafficJournal) save(journal *trafficJournalFile) error {
+	if journal.Batch == nil && len(journal.Traffic) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove traffic journal error: %s", err)
+		}
+		return nil
+	}
+	if err := checkPath(j.path); err != nil {
+		return err
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("marshal traffic journal error: %s", err)
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open traffic journal error: %s", err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write traffic journal error: %s", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("rename traffic journal error: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/common/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collect implements metrics.Source.
+func (n *Node) Collect(ch chan<- prometheus.Metric) {
+	n.access.RLock()
+	defer n.access.RUnlock()
+	for _, c := range n.controllers {
+		if c.tag == "" || c.limiter == nil {
+			continue
+		}
+		c.collect(ch)
+	}
+}
+
+func (c *Controller) collect(ch chan<- prometheus.Metric) {
+	up, down, users := c.server.TrafficTotals(c.tag)
+	ch <- prometheus.MustNewConstMetric(metrics.TrafficBytesDesc,
+		prometheus.CounterValue, float64(up), c.tag, "up")
+	ch <- prometheus.MustNewConstMetric(metrics.TrafficBytesDesc,
+		prometheus.CounterValue, float64(down), c.tag, "down")
+	for _, u := range users {
+		uid := strconv.Itoa(u.UID)
+		ch <- prometheus.MustNewConstMetric(metrics.UserTrafficBytesDesc,
+			prometheus.CounterValue, float64(u.Upload), c.tag, uid, "up")
+		ch <- prometheus.MustNewConstMetric(metrics.UserTrafficBytesDesc,
+			prometheus.CounterValue, float64(u.Download), c.tag, uid, "down")
+	}
+	for uid, ips := range c.limiter.OnlineIPs() {
+		ch <- prometheus.MustNewConstMetric(metrics.UserOnlineIPsDesc,
+			prometheus.GaugeValue, float64(ips), c.tag, strconv.Itoa(uid))
+	}
+	for uid, links := range c.server.UserLinks(c.tag) {
+		ch <- prometheus.MustNewConstMetric(metrics.UserActiveLinksDesc,
+			prometheus.GaugeValue, float64(links), c.tag, strconv.Itoa(uid))
+	}
+	if days, ok := c.certExpiryDays(); ok {
+		ch <- prometheus.MustNewConstMetric(metrics.CertExpiryDaysDesc,
+			prometheus.GaugeValue, days, c.tag)
+	}
+}
+
+// certExpiryDays returns the days until the certificate of the node expires.
+func (c *Controller) certExpiryDays() (float64, bool) {
+	if security(c.info) != "tls" {
+		return 0, false
+	}
+	certFile := filepath.Join("/etc/PPanel-node/", c.info.Type+strconv.Itoa(c.info.Id)+".cer")
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return 0, false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return 0, false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return 0, false
+	}
+	return time.Until(cert.NotAfter).Hours() / 24, true
+}
@@ -1,21 +1,44 @@
 package node
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/perfect-panel/ppanel-node/api/panel"
 	"github.com/perfect-panel/ppanel-node/conf"
 	vCore "github.com/perfect-panel/ppanel-node/core"
+	"github.com/perfect-panel/ppanel-node/limiter"
+	log "github.com/sirupsen/logrus"
 )
 
 type Node struct {
+	core        *vCore.XrayCore
+	config      *conf.Conf
+	access      sync.RWMutex
 	controllers []*Controller
 }
 
 func New(core *vCore.XrayCore, config *conf.Conf, serverconfig *panel.ServerConfigResponse) (*Node, error) {
 	node := &Node{
+		core:        core,
+		config:      config,
 		controllers: make([]*Controller, len(*serverconfig.Data.Protocols)),
 	}
+	for i, nodeconfig := range *serverconfig.Data.Protocols {
+		c, err := node.newController(newNodeInfo(config, serverconfig, &nodeconfig))
+		if err != nil {
+			return nil, err
+		}
+		node.controllers[i] = c
+	}
+
+	return node, nil
+}
+
+func newNodeInfo(config *conf.Conf, serverconfig *panel.ServerConfigResponse, protocol *panel.Protocol) *panel.NodeInfo {
 	pushinterval := serverconfig.Data.PushInterval
 	if pushinterval <= 0 {
 		pushinterval = 60
@@ -24,31 +47,32 @@ func New(core *vCore.XrayCore, config *conf.Conf, serverconfig *panel.ServerConf
 	if pullinterval <= 0 {
 		pullinterval = 60
 	}
-	for i, nodeconfig := range *serverconfig.Data.Protocols {
-		n := &panel.NodeInfo{
-			Id:                     config.ApiConfig.ServerId,
-			Type:                   nodeconfig.Type,
-			TrafficReportThreshold: serverconfig.Data.TrafficReportThreshold,
-			PushInterval:           pushinterval,
-			PullInterval:           pullinterval,
-			Protocol:               &nodeconfig,
-		}
-		p, err := panel.NewClientV1(&conf.NodeApiConfig{
-			APIHost:   config.ApiConfig.ApiHost,
-			NodeType:  nodeconfig.Type,
-			NodeID:    config.ApiConfig.ServerId,
-			SecretKey: config.ApiConfig.SecretKey,
-		})
-		if err != nil {
-			return nil, err
-		}
-		node.controllers[i] = NewController(core, p, n)
+	return &panel.NodeInfo{
+		Id:                     config.ApiConfig.ServerId,
+		Type:                   protocol.Type,
+		TrafficReportThreshold: serverconfig.Data.TrafficReportThreshold,
+		PushInterval:           pushinterval,
+		PullInterval:           pullinterval,
+		Protocol:               protocol,
 	}
+}
 
-	return node, nil
+func (n *Node) newController(info *panel.NodeInfo) (*Controller, error) {
+	api, err := n.core.Provider.NodeClient(info.Type)
+	if err != nil {
+		return nil, err
+	}
+	return NewController(n.core, api, info), nil
 }
 
 func (n *Node) Start() error {
+	limit := n.config.LimitConfig
+	limiter.SetNodeSpeedLimit(limit.SpeedLimit, limit.UpSpeedLimit, limit.DownSpeedLimit)
+	schedules, err := limiter.NewSchedules(limit.Schedules)
+	if err != nil {
+		return fmt.Errorf("speed schedule error: %s", err)
+	}
+	limiter.SetNodeSchedules(schedules)
 	for i := range n.controllers {
 		if !n.controllers[i].info.Protocol.Enable {
 			continue
@@ -56,7 +80,7 @@ func (n *Node) Start() error {
 		err := n.controllers[i].Start()
 		if err != nil {
 			return fmt.Errorf("启动节点 [%s-%s-%d] 失败: %s",
-				n.controllers[i].apiClient.APIHost,
+				n.config.ApiConfig.ApiHost,
 				n.controllers[i].info.Type,
 				n.controllers[i].info.Id,
 				err)
@@ -65,12 +89,117 @@ func (n *Node) Start() error {
 	return nil
 }
 
-func (n *Node) Close() {
+// Close closes all controllers, a failing one does not keep the others
+// running. The errors of all controllers are returned joined.
+func (n *Node) Close() error {
+	n.access.Lock()
+	defer n.access.Unlock()
+	return n.close()
+}
+
+// close closes all controllers, n.access must be held.
+func (n *Node) close() error {
+	var errs []error
 	for _, c := range n.controllers {
-		err := c.Close()
-		if err != nil {
-			panic(err)
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("关闭节点 [%s] 失败: %w", c.tag, err))
 		}
 	}
 	n.controllers = nil
+	return errors.Join(errs...)
+}
+
+// Shutdown closes all controllers gracefully. New connections are refused at
+// once, established ones get up to grace to finish, then traffic and online
+// users are reported to the panel one last time. Updates wait until it is
+// done.
+func (n *Node) Shutdown(grace time.Duration) error {
+	n.access.Lock()
+	defer n.access.Unlock()
+	var running []*Controller
+	for _, c := range n.controllers {
+		if c.tag == "" {
+			continue
+		}
+		c.stopTasks()
+		if err := c.stopAccepting(); err != nil {
+			log.WithFields(log.Fields{
+				"tag": c.tag,
+				"err": err,
+			}).Error("Stop accepting connections failed")
+		}
+		running = append(running, c)
+	}
+	deadline := time.Now().Add(grace)
+	for _, c := range running {
+		c.drain(deadline)
+	}
+	for _, c := range running {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		c.pendingTraffic.ClearBackoff()
+		_ = c.reportUserTrafficTask(ctx)
+		cancel()
+	}
+	return n.close()
+}
+
+// Update applies a changed server config to the running controllers. Nodes
+// whose protocol is unchanged keep running untouched, changed ones only get
+// their inbound rebuilt, removed ones are closed and new ones are started.
+func (n *Node) Update(serverconfig *panel.ServerConfigResponse) error {
+	n.access.Lock()
+	defer n.access.Unlock()
+	protocols := *serverconfig.Data.Protocols
+	enabled := make(map[string]struct{}, len(protocols))
+	for i := range protocols {
+		if protocols[i].Enable {
+			enabled[protocols[i].Type] = struct{}{}
+		}
+	}
+	running := make(map[string]*Controller, len(n.controllers))
+	for _, c := range n.controllers {
+		if c.tag == "" {
+			continue
+		}
+		if _, ok := enabled[c.info.Type]; !ok {
+			if err := c.Close(); err != nil {
+				return fmt.Errorf("关闭节点 [%s] 失败: %s", c.tag, err)
+			}
+			log.WithField("节点", c.tag).Info("节点已移除")
+			continue
+		}
+		running[c.info.Type] = c
+	}
+	controllers := make([]*Controller, 0, len(protocols))
+	defer func() {
+		// keep controllers not reached because of an error, so they are closed later
+		for _, c := range running {
+			controllers = append(controllers, c)
+		}
+		n.controllers = controllers
+	}()
+	for i := range protocols {
+		info := newNodeInfo(n.config, serverconfig, &protocols[i])
+		if c, ok := running[info.Type]; ok && info.Protocol.Enable {
+			delete(running, info.Type)
+			controllers = append(controllers, c)
+			if err := c.update(info); err != nil {
+				return fmt.Errorf("更新节点 [%s] 失败: %s", c.tag, err)
+			}
+			continue
+		}
+		c, err := n.newController(info)
+		if err != nil {
+			return err
+		}
+		if info.Protocol.Enable {
+			if err := c.Start(); err != nil {
+				_ = c.Close()
+				return fmt.Errorf("启动节点 [%s-%s-%d] 失败: %s",
+					n.config.ApiConfig.ApiHost, info.Type, info.Id, err)
+			}
+		}
+		controllers = append(controllers, c)
+	}
+	return nil
 }
@@ -0,0 +1,64 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/perfect-panel/ppanel-node/api/memory"
+	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/conf"
+	vCore "github.com/perfect-panel/ppanel-node/core"
+	"github.com/perfect-panel/ppanel-node/limiter"
+)
+
+func TestNodeFollowsProviderUsers(t *testing.T) {
+	limiter.Init()
+	protocols := []panel.Protocol{
+		{Type: "vless", Port: freePort(t), Transport: "tcp", Enable: true},
+	}
+	serverconfig := &panel.ServerConfigResponse{
+		Data: &panel.Data{
+			IPStrategy: "prefer_ipv4",
+			Protocols:  &protocols,
+		},
+	}
+	provider := memory.New(serverconfig)
+	provider.SetUsers("vless", []panel.UserInfo{
+		{Id: 1, Uuid: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+		{Id: 2, Uuid: "0d6f1a4e-5f0c-4b8e-9a47-36c5d2a3f7b1"},
+	})
+	c := conf.New()
+	c.DataDir = t.TempDir()
+	xcore := vCore.New(c, provider)
+	if err := xcore.Start(serverconfig); err != nil {
+		t.Fatalf("XrayCore.Start() error: %v", err)
+	}
+	defer xcore.Close()
+	n, err := New(xcore, c, serverconfig)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if err := n.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer n.Close()
+
+	inbounds := n.Inbounds()
+	if len(inbounds) != 1 || inbounds[0].Users != 2 {
+		t.Fatalf("Inbounds() = %+v, want 1 inbound with 2 users", inbounds)
+	}
+
+	provider.SetUsers("vless", []panel.UserInfo{
+		{Id: 2, Uuid: "0d6f1a4e-5f0c-4b8e-9a47-36c5d2a3f7b1"},
+	})
+	if err := n.controllers[0].userListMonitor(context.Background()); err != nil {
+		t.Fatalf("userListMonitor() error: %v", err)
+	}
+	users, err := n.Users(inbounds[0].Tag)
+	if err != nil {
+		t.Fatalf("Users() error: %v", err)
+	}
+	if len(users) != 1 || users[0].UID != 2 {
+		t.Fatalf("Users() = %+v, want only user 2", users)
+	}
+}
@@ -0,0 +1,191 @@
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/perfect-panel/ppanel-node/api/panel"
+)
+
+// maxTrafficBackoff caps the delay between two failed traffic pushes.
+const maxTrafficBackoff = 30 * time.Minute
+
+// trafficBuffer keeps user traffic that has been taken from the counters but
+// not yet acknowledged by the panel. Deltas are merged per UID until they are
+// cut into a batch, a failed batch is retried unchanged and the traffic
+// counted meanwhile waits for the next one.
+type trafficBuffer struct {
+	access   sync.Mutex
+	traffic  map[int]*panel.UserTraffic
+	batch    *trafficBatch
+	failures int
+	retryAt  time.Time
+}
+
+// trafficBatch is traffic pushed to the panel. It keeps its idempotency key
+// until the panel accepts it, so a retry, even after a restart, is counted
+// once.
+type trafficBatch struct {
+	Key     string              `json:"key"`
+	Traffic []panel.UserTraffic `json:"traffic"`
+}
+
+func newTrafficBuffer() *trafficBuffer {
+	return &trafficBuffer{
+		traffic: make(map[int]*panel.UserTraffic),
+	}
+}
+
+// Merge adds the given deltas to the pending traffic.
+func (b *trafficBuffer) Merge(traffic []panel.UserTraffic) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.merge(traffic)
+}
+
+// merge adds the given deltas to the pending traffic. b.access must be held.
+func (b *trafficBuffer) merge(traffic []panel.UserTraffic) {
+	for _, t := range traffic {
+		if t.UID == 0 || t.Upload+t.Download == 0 {
+			continue
+		}
+		if p, ok := b.traffic[t.UID]; ok {
+			p.Upload += t.Upload
+			p.Download += t.Download
+			continue
+		}
+		b.traffic[t.UID] = &panel.UserTraffic{
+			UID:      t.UID,
+			Upload:   t.Upload,
+			Download: t.Download,
+		}
+	}
+}
+
+// Pending returns a snapshot of the traffic waiting to be pushed, the batch
+// included.
+func (b *trafficBuffer) Pending() []panel.UserTraffic {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.batch == nil {
+		return b.unbatched()
+	}
+	traffic := newTrafficBuffer()
+	traffic.merge(b.batch.Traffic)
+	traffic.merge(b.unbatched())
+	return traffic.unbatched()
+}
+
+// Snapshot returns a copy of the batch, nil when there is none, and the
+// traffic merged after it was cut.
+func (b *trafficBuffer) Snapshot() (*trafficBatch, []panel.UserTraffic) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	var batch *trafficBatch
+	if b.batch != nil {
+		batch = &trafficBatch{
+			Key:     b.batch.Key,
+			Traffic: append([]panel.UserTraffic(nil), b.batch.Traffic...),
+		}
+	}
+	return batch, b.unbatched()
+}
+
+// unbatched returns the traffic merged after the batch was cut, sorted by
+// UID. b.access must be held.
+func (b *trafficBuffer) unbatched() []panel.UserTraffic {
+	traffic := make([]panel.UserTraffic, 0, len(b.traffic))
+	for _, t := range b.traffic {
+		traffic = append(traffic, *t)
+	}
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].UID < traffic[j].UID
+	})
+	return traffic
+}
+
+// Restore sets the batch left by a previous run, it is pushed again with
+// its key. It is merged like other traffic when a batch is already cut.
+func (b *trafficBuffer) Restore(batch *trafficBatch) {
+	if batch == nil || len(batch.Traffic) == 0 {
+		return
+	}
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.batch == nil {
+		b.batch = batch
+		return
+	}
+	b.merge(batch.Traffic)
+}
+
+// Len returns the number of users with pending traffic.
+func (b *trafficBuffer) Len() int {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.batch != nil {
+		return len(b.traffic) + len(b.batch.Traffic)
+	}
+	return len(b.traffic)
+}
+
+// Batch returns the batch to push, the pending traffic is cut into a new
+// one when there is none. The second result reports whether the batch is
+// new. It returns nil when no traffic is pending.
+func (b *trafficBuffer) Batch() (*trafficBatch, bool) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.batch != nil {
+		return b.batch, false
+	}
+	if len(b.traffic) == 0 {
+		return nil, false
+	}
+	b.batch = &trafficBatch{
+		Key:     panel.NewIdempotencyKey(),
+		Traffic: b.unbatched(),
+	}
+	b.traffic = make(map[int]*panel.UserTraffic)
+	return b.batch, true
+}
+
+// Ack removes the batch accepted by the panel and resets the backoff.
+func (b *trafficBuffer) Ack(batch *trafficBatch) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.batch == batch {
+		b.batch = nil
+	}
+	b.failures = 0
+	b.retryAt = time.Time{}
+}
+
+// Failed records a failed push and returns the delay before the next attempt.
+// The delay starts at base and doubles on each consecutive failure.
+func (b *trafficBuffer) Failed(base time.Duration) time.Duration {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.failures++
+	backoff := base
+	for i := 1; i < b.failures && backoff < maxTrafficBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxTrafficBackoff)
+	b.retryAt = time.Now().Add(backoff)
+	return backoff
+}
+
+// ClearBackoff allows the next push to be attempted immediately.
+func (b *trafficBuffer) ClearBackoff() {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.retryAt = time.Time{}
+}
+
+// Ready reports whether the backoff of the last failure has elapsed.
+func (b *trafficBuffer) Ready() bool {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return !time.Now().Before(b.retryAt)
+}
@@ -2,59 +2,133 @@ package node
 
 import (
 	"context"
-	"strconv"
+	"fmt"
 	"time"
 
 	"github.com/perfect-panel/ppanel-node/api/panel"
+	"github.com/perfect-panel/ppanel-node/common/counter"
+	"github.com/perfect-panel/ppanel-node/common/format"
 	"github.com/perfect-panel/ppanel-node/common/serverstatus"
 	"github.com/perfect-panel/ppanel-node/common/task"
 	vCore "github.com/perfect-panel/ppanel-node/core"
 	log "github.com/sirupsen/logrus"
 )
 
+// trafficJournalInterval is how often counted traffic is written to disk.
+const trafficJournalInterval = 10 * time.Second
+
+// quotaCheckInterval is how often the traffic of the users is compared
+// against their quota.
+const quotaCheckInterval = time.Second
+
+// dynamicLimitInterval is how often the users are sampled for the dynamic
+// speed limit rules.
+const dynamicLimitInterval = 10 * time.Second
+
+// deviceEvictInterval is how often the links of evicted devices are closed.
+const deviceEvictInterval = time.Second
+
+// scheduleCheckInterval is how often the speed schedules are checked for a
+// start or an end.
+const scheduleCheckInterval = time.Second
+
+// maxThrottleEvents caps the throttle events kept while the panel is unreachable.
+const maxThrottleEvents = 1000
+
 func (c *Controller) startTasks(node *panel.NodeInfo) {
 	// fetch user list task
 	c.userListMonitorPeriodic = &task.Task{
 		Name:     "userListMonitor",
+		Tag:      c.tag,
 		Interval: time.Duration(node.PullInterval) * time.Second,
 		Execute:  c.userListMonitor,
 		ReloadCh: c.server.ReloadCh,
 	}
+	// fetch alive list task
+	if interval := c.aliveInterval(); interval > 0 {
+		c.aliveListPeriodic = &task.Task{
+			Name:     "aliveListMonitor",
+			Tag:      c.tag,
+			Interval: interval,
+			Execute:  c.aliveListMonitor,
+			ReloadCh: c.server.ReloadCh,
+		}
+	}
 	// report user traffic task
 	c.userReportPeriodic = &task.Task{
 		Name:     "reportUserTraffic",
+		Tag:      c.tag,
 		Interval: time.Duration(node.PushInterval) * time.Second,
 		Execute:  c.reportUserTrafficTask,
 		ReloadCh: c.server.ReloadCh,
 	}
+	// flush traffic journal task
+	c.journalPeriodic = &task.Task{
+		Name:     "flushTrafficJournal",
+		Tag:      c.tag,
+		Interval: trafficJournalInterval,
+		Execute:  c.flushTrafficJournal,
+		ReloadCh: c.server.ReloadCh,
+	}
+	// check user quota task
+	c.quotaPeriodic = &task.Task{
+		Name:     "quotaMonitor",
+		Tag:      c.tag,
+		Interval: quotaCheckInterval,
+		Execute:  c.quotaMonitor,
+		ReloadCh: c.server.ReloadCh,
+	}
+	// dynamic speed limit task
+	if c.rules != nil {
+		c.dynamicLimitPeriodic = &task.Task{
+			Name:     "dynamicLimitMonitor",
+			Tag:      c.tag,
+			Interval: dynamicLimitInterval,
+			Execute:  c.dynamicLimitMonitor,
+			ReloadCh: c.server.ReloadCh,
+		}
+	}
+	// close evicted devices task
+	if c.limiter.DeviceEvict {
+		c.devicePeriodic = &task.Task{
+			Name:     "deviceMonitor",
+			Tag:      c.tag,
+			Interval: deviceEvictInterval,
+			Execute:  c.deviceMonitor,
+			ReloadCh: c.server.ReloadCh,
+		}
+	}
+	// speed schedule task
+	c.schedulePeriodic = &task.Task{
+		Name:     "speedScheduleMonitor",
+		Tag:      c.tag,
+		Interval: scheduleCheckInterval,
+		Execute:  c.speedScheduleMonitor,
+		ReloadCh: c.server.ReloadCh,
+	}
 	_ = c.userListMonitorPeriodic.Start(false)
 	log.WithField("节点", c.tag).Info("用户列表监控任务已启动")
+	if c.aliveListPeriodic != nil {
+		_ = c.aliveListPeriodic.Start(false)
+	}
 	_ = c.userReportPeriodic.Start(false)
 	log.WithField("节点", c.tag).Info("用户流量报告任务已启动")
-	var security string
-	switch node.Type {
-	case "vless":
-		security = node.Protocol.Security
-	case "vmess":
-		security = node.Protocol.Security
-	case "trojan":
-		security = node.Protocol.Security
-	case "shadowsocks":
-		security = ""
-	case "tuic":
-		security = "tls"
-	case "hysteria", "hysteria2":
-		security = "tls"
-	default:
-		security = ""
+	_ = c.journalPeriodic.Start(false)
+	_ = c.quotaPeriodic.Start(false)
+	if c.dynamicLimitPeriodic != nil {
+		_ = c.dynamicLimitPeriodic.Start(false)
 	}
-
-	if security == "tls" {
+	if c.devicePeriodic != nil {
+		_ = c.devicePeriodic.Start(false)
+	}
+	_ = c.schedulePeriodic.Start(false)
+	if security(node) == "tls" {
 		switch node.Protocol.CertMode {
 		case "none", "", "file", "self":
 		default:
 			c.renewCertPeriodic = &task.Task{
 				Name:     "renewCert",
+				Tag:      c.tag,
 				Interval: time.Hour * 24,
 				Execute:  c.renewCertTask,
 				ReloadCh: c.server.ReloadCh,
@@ -66,54 +140,84 @@ func (c *Controller) startTasks(node *panel.NodeInfo) {
 	}
 }
 
-func (c *Controller) reloadTask() {
-	c.userListMonitorPeriodic.Close()
-	c.userReportPeriodic.Close()
-	if c.renewCertPeriodic != nil {
-		c.renewCertPeriodic.Close()
+// security returns the transport security used by the node.
+func security(node *panel.NodeInfo) string {
+	switch node.Type {
+	case "vless":
+		return node.Protocol.Security
+	case "vmess":
+		return node.Protocol.Security
+	case "trojan":
+		return node.Protocol.Security
+	case "shadowsocks":
+		return ""
+	case "tuic":
+		return "tls"
+	case "hysteria", "hysteria2":
+		return "tls"
+	default:
+		return ""
 	}
+}
+
+func (c *Controller) reloadTask() {
+	c.stopTasks()
 	c.startTasks(c.info)
 }
 
+// aliveStaleAfter is how many refresh intervals a failing alive list is
+// kept. It is cleared afterwards, so users are not refused with stale counts.
+const aliveStaleAfter = 3
 
-func (c *Controller) userListMonitor(ctx context.Context) (err error) {
-	// get user info
-	newU, err := c.apiClient.GetUserList(ctx)
+func (c *Controller) aliveInterval() time.Duration {
+	return time.Duration(c.server.Config.ApiConfig.AliveInterval) * time.Second
+}
+
+func (c *Controller) aliveListMonitor(ctx context.Context) error {
+	alive, err := c.apiClient.GetUserAlive(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tag": c.tag,
 			"err": err,
-		}).Error("Get user list failed")
-		return nil
+		}).Error("Get alive list failed")
+		if time.Since(c.aliveUpdated) > aliveStaleAfter*c.aliveInterval() {
+			c.limiter.SetAliveList(make(map[int]int))
+		}
+		return task.ErrFailed
 	}
-	// get user alive
-	newA, err := c.apiClient.GetUserAlive()
+	c.limiter.SetAliveList(alive)
+	c.aliveUpdated = time.Now()
+	return nil
+}
+
+func (c *Controller) userListMonitor(ctx context.Context) (err error) {
+	// get user info
+	newU, err := c.apiClient.GetUserList(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tag": c.tag,
 			"err": err,
-		}).Error("Get alive list failed")
-		return nil
-	}
-	// update alive list
-	if newA != nil {
-		c.limiter.AliveList = newA
+		}).Error("Get user list failed")
+		return task.ErrFailed
 	}
 	// update user list
 	// newU == nil indicates 304 Not Modified; empty slice means the list is empty
 	if newU == nil {
 		return nil
 	}
-	deleted, added := compareUserList(c.userList, newU)
+	deleted, added, changed := compareUserList(c.userList, newU)
 	if len(deleted) > 0 {
 		// have deleted users
-		err = c.server.DelUsers(deleted, c.tag, c.info)
+		// The traffic of the deleted users is reported with the next push
+		var traffic []panel.UserTraffic
+		traffic, err = c.server.DelUsers(deleted, c.tag, c.info)
+		c.pendingTraffic.Merge(traffic)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"tag": c.tag,
 				"err": err,
 			}).Error("Delete users failed")
-			return nil
+			return task.ErrFailed
 		}
 	}
 	if len(added) > 0 {
@@ -128,7 +232,7 @@ func (c *Controller) userListMonitor(ctx context.Context) (err error) {
 				"tag": c.tag,
 				"err": err,
 			}).Error("Add users failed")
-			return nil
+			return task.ErrFailed
 		}
 	}
 	if len(added) > 0 || len(deleted) > 0 {
@@ -142,11 +246,133 @@ func (c *Controller) userListMonitor(ctx context.Context) (err error) {
 			return nil
 		}
 	}
+	if len(changed) > 0 {
+		// Limits are applied in place, the links of the users are kept
+		c.limiter.UpdateLimits(c.tag, changed)
+		c.reconnectUsers()
+	}
+	c.updateQuota(newU)
 	c.userList = newU
 	if len(added)+len(deleted) != 0 {
 		log.WithField("节点", c.tag).
 			Infof("删除 %d 个用户，新增 %d 个用户", len(deleted), len(added))
 	}
+	if len(changed) != 0 {
+		log.WithField("节点", c.tag).Infof("更新 %d 个用户的限制", len(changed))
+	}
+	return nil
+}
+
+// updateQuota sets the quota of the users to the traffic used reported by
+// the panel. The traffic counted on the node that the panel has not accepted
+// yet is not part of it, so it is added.
+func (c *Controller) updateQuota(users []panel.UserInfo) {
+	tc := c.server.TrafficCounter(c.tag)
+	pending := make(map[int]int64)
+	for _, t := range c.pendingTraffic.Pending() {
+		pending[t.UID] = t.Upload + t.Download
+	}
+	for i := range users {
+		taguuid := format.UserTag(c.tag, users[i].Uuid)
+		used := users[i].Used + pending[users[i].Id]
+		var base int64
+		if tc != nil {
+			if v, ok := tc.Counters.Load(taguuid); ok {
+				ts := v.(*counter.TrafficStorage)
+				base = ts.UpTotal.Load() + ts.DownTotal.Load()
+				used += ts.UpCounter.Load() + ts.DownCounter.Load()
+			}
+		}
+		c.limiter.SetQuota(taguuid, users[i].Quota, used, base)
+	}
+}
+
+// quotaMonitor closes the links of the users that went over their quota, so
+// they are refused or throttled when they connect again.
+func (c *Controller) quotaMonitor(_ context.Context) error {
+	for taguuid, uid := range c.limiter.CheckQuota(c.server.TrafficCounter(c.tag)) {
+		links := c.server.CloseUserLinks(taguuid)
+		log.WithField("节点", c.tag).Infof("用户 %d 已超出流量配额，关闭 %d 个连接", uid, links)
+	}
+	c.reconnectUsers()
+	return nil
+}
+
+// reconnectUsers closes the links of the users that got a speed limit while
+// their links were unlimited, so they reconnect at the limit.
+func (c *Controller) reconnectUsers() {
+	for taguuid, uid := range c.limiter.Reconnects() {
+		if links := c.server.CloseUserLinks(taguuid); links > 0 {
+			log.WithField("节点", c.tag).Infof("用户 %d 已被限速，关闭 %d 个未限速连接", uid, links)
+		}
+	}
+}
+
+// deviceMonitor closes the links of the devices evicted from users at their
+// device limit once their grace period is over.
+func (c *Controller) deviceMonitor(_ context.Context) error {
+	for _, e := range c.limiter.DueEvictions(time.Now()) {
+		links := c.server.CloseDeviceLinks(e.TagUUID, func(ip string) bool {
+			return c.limiter.DeviceOf(ip) == e.Device
+		})
+		log.WithField("节点", c.tag).Infof("用户 %d 已达设备数上限，移除最久未连接的设备 %s，关闭 %d 个连接", e.UID, e.Device, links)
+	}
+	return nil
+}
+
+// speedScheduleMonitor applies the speed schedules when one starts or ends
+// and removes the expired dynamic speed limits. The buckets of the users are
+// re-rated, their links are kept unless they were unlimited.
+func (c *Controller) speedScheduleMonitor(_ context.Context) error {
+	now := time.Now()
+	if users := c.limiter.ApplySchedules(now); users >= 0 {
+		log.WithField("节点", c.tag).Infof("限速时段已变更，已调整 %d 个用户的限速", users)
+	}
+	if users := c.limiter.ExpireDynamicLimits(now); users > 0 {
+		log.WithField("节点", c.tag).Infof("%d 个用户的动态限速已到期", users)
+	}
+	c.reconnectUsers()
+	return nil
+}
+
+// dynamicLimitMonitor caps the users matching a dynamic speed limit rule and
+// reports them to the panel when ReportThrottle is set. Their buckets are
+// re-rated, so the cap applies to their open links too.
+func (c *Controller) dynamicLimitMonitor(ctx context.Context) error {
+	now := time.Now()
+	throttles := c.rules.Check(c.limiter, c.server.TrafficCounter(c.tag), c.server.UserLinks(c.tag), now)
+	c.reconnectUsers()
+	for _, t := range throttles {
+		log.WithField("节点", c.tag).Infof("用户 %d 触发动态限速规则 %d (%d Mbps, %d 个连接)，限速 %d Mbps 至 %s",
+			t.UID, t.Rule, t.Speed, t.Connections, t.SpeedLimit, t.Expire.Format(time.DateTime))
+		if !c.server.Config.LimitConfig.ReportThrottle {
+			continue
+		}
+		c.throttleEvents = append(c.throttleEvents, panel.ThrottleEvent{
+			UID:         t.UID,
+			Rule:        t.Rule,
+			Speed:       t.Speed,
+			Connections: t.Connections,
+			SpeedLimit:  t.SpeedLimit,
+			Time:        now.Unix(),
+			Expire:      t.Expire.Unix(),
+		})
+	}
+	if over := len(c.throttleEvents) - maxThrottleEvents; over > 0 {
+		c.throttleEvents = c.throttleEvents[over:]
+	}
+	if len(c.throttleEvents) == 0 {
+		return nil
+	}
+	if err := c.apiClient.ReportUserThrottle(ctx, &c.throttleEvents); err != nil {
+		log.WithFields(log.Fields{
+			"tag":    c.tag,
+			"err":    err,
+			"events": len(c.throttleEvents),
+		}).Warn("Report throttle events failed, events kept for retry")
+		return task.ErrFailed
+	}
+	c.throttleEvents = nil
 	return nil
 }
 
@@ -156,17 +382,9 @@ func (c *Controller) reportUserTrafficTask(ctx context.Context) (err error) {
 		reportmin = c.info.TrafficReportThreshold
 	}
 	userTraffic, _ := c.server.GetUserTrafficSlice(c.tag, reportmin)
-	if len(userTraffic) > 0 {
-		err = c.apiClient.ReportUserTraffic(ctx, &userTraffic)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"tag": c.tag,
-				"err": err,
-			}).Info("Report user traffic failed")
-		} else {
-			log.WithField("节点", c.tag).Infof("已上报 %d 名用户消耗流量", len(userTraffic))
-		}
-	}
+	// The counters are already reset, keep the deltas until the panel accepts them
+	c.pendingTraffic.Merge(userTraffic)
+	failed := !c.pushPendingTraffic(ctx)
 
 	if onlineDevice, err := c.limiter.GetOnlineDevice(); err != nil {
 		log.Print(err)
@@ -190,6 +408,7 @@ func (c *Controller) reportUserTrafficTask(ctx context.Context) (err error) {
 				"tag": c.tag,
 				"err": err,
 			}).Info("Report online users failed")
+			failed = true
 		} else {
 			log.WithField("节点", c.tag).Infof("总计 %d 名在线用户, %d 名已上报", len(*onlineDevice), len(result))
 		}
@@ -199,7 +418,7 @@ func (c *Controller) reportUserTrafficTask(ctx context.Context) (err error) {
 	if err != nil {
 		log.Print(err)
 	}
-	err = c.apiClient.ReportNodeStatus(
+	err = c.apiClient.ReportNodeStatus(ctx,
 		&panel.NodeStatus{
 			CPU:    CPU,
 			Mem:    Mem,
@@ -208,24 +427,114 @@ func (c *Controller) reportUserTrafficTask(ctx context.Context) (err error) {
 		})
 	if err != nil {
 		log.Print(err)
+		failed = true
 	}
 
 	userTraffic = nil
+	if failed {
+		return task.ErrFailed
+	}
+	return nil
+}
+
+// pushPendingTraffic reports all unacknowledged traffic to the panel.
+// The traffic is cut into a batch which is journaled with its idempotency
+// key before it is pushed and removed from the journal as soon as the panel
+// accepts it, so a crash in between never reports it twice. On failure the
+// batch stays buffered and the next attempt is delayed with an exponential
+// backoff. It returns false while traffic is left.
+func (c *Controller) pushPendingTraffic(ctx context.Context) bool {
+	if c.pendingTraffic.Len() == 0 {
+		return true
+	}
+	if !c.pendingTraffic.Ready() {
+		log.WithField("节点", c.tag).Debugf("%d 名用户流量等待重试上报", c.pendingTraffic.Len())
+		_ = c.flushTrafficJournal(ctx)
+		return false
+	}
+	batch, cut := c.pendingTraffic.Batch()
+	if cut {
+		_ = c.flushTrafficJournal(ctx)
+	}
+	if err := c.apiClient.ReportUserTraffic(panel.WithIdempotencyKey(ctx, batch.Key), &batch.Traffic); err != nil {
+		backoff := c.pendingTraffic.Failed(time.Duration(c.info.PushInterval) * time.Second)
+		log.WithFields(log.Fields{
+			"tag":   c.tag,
+			"err":   err,
+			"users": len(batch.Traffic),
+			"retry": backoff,
+		}).Warn("Report user traffic failed, traffic kept for retry")
+		if !cut {
+			_ = c.flushTrafficJournal(ctx)
+		}
+		return false
+	}
+	c.pendingTraffic.Ack(batch)
+	_ = c.flushTrafficJournal(ctx)
+	log.WithField("节点", c.tag).Infof("已上报 %d 名用户消耗流量", len(batch.Traffic))
+	return true
+}
+
+// flushTrafficJournal writes the unacknowledged traffic and the traffic
+// counted since the last push to the journal.
+func (c *Controller) flushTrafficJournal(_ context.Context) error {
+	err := c.journal.Update(func() *trafficJournalFile {
+		batch, pending := c.pendingTraffic.Snapshot()
+		traffic := newTrafficBuffer()
+		traffic.Merge(pending)
+		traffic.Merge(c.server.PeekUserTraffic(c.tag))
+		return &trafficJournalFile{
+			Batch:   batch,
+			Traffic: traffic.Pending(),
+		}
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Error("Flush traffic journal failed")
+		return task.ErrFailed
+	}
 	return nil
 }
 
-func compareUserList(old, new []panel.UserInfo) (deleted, added []panel.UserInfo) {
+// replayTrafficJournal reports the traffic left in the journal by a previous
+// run. A batch left in the journal is pushed again with its idempotency key.
+func (c *Controller) replayTrafficJournal() {
+	journal, err := c.journal.Load()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tag": c.tag,
+			"err": err,
+		}).Error("Load traffic journal failed")
+		return
+	}
+	c.pendingTraffic.Restore(journal.Batch)
+	c.pendingTraffic.Merge(journal.Traffic)
+	if c.pendingTraffic.Len() == 0 {
+		return
+	}
+	log.WithField("节点", c.tag).Infof("从流量日志恢复 %d 名用户未上报流量", c.pendingTraffic.Len())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c.pushPendingTraffic(ctx)
+}
+
+func compareUserList(old, new []panel.UserInfo) (deleted, added, changed []panel.UserInfo) {
 	oldMap := make(map[string]int)
 	for i, user := range old {
-		key := user.Uuid + strconv.Itoa(user.SpeedLimit)
+		key := userKey(&user)
 		oldMap[key] = i
 	}
 
 	for _, user := range new {
-		key := user.Uuid + strconv.Itoa(user.SpeedLimit)
-		if _, exists := oldMap[key]; !exists {
+		key := userKey(&user)
+		if i, exists := oldMap[key]; !exists {
 			added = append(added, user)
 		} else {
+			if limitsChanged(&old[i], &user) {
+				changed = append(changed, user)
+			}
 			delete(oldMap, key)
 		}
 	}
@@ -234,6 +543,20 @@ func compareUserList(old, new []panel.UserInfo) (deleted, added []panel.UserInfo
 		deleted = append(deleted, old[index])
 	}
 
-	return deleted, added
+	return deleted, added, changed
+}
+
+// userKey identifies a user in the inbound, a user whose key changed is
+// added again.
+func userKey(user *panel.UserInfo) string {
+	return fmt.Sprintf("%s/%d", user.Uuid, user.Id)
 }
 
+// limitsChanged reports whether the limits of a user changed. The quota is
+// not compared, it is set on every user list by updateQuota.
+func limitsChanged(old, new *panel.UserInfo) bool {
+	a, b := *old, *new
+	a.Quota, a.Used = 0, 0
+	b.Quota, b.Used = 0, 0
+	return a != b
+}